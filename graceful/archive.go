@@ -0,0 +1,219 @@
+package graceful
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	archivePrefix      = "binary-"
+	defaultMaxArchived = 5
+	// archiveChecksumLength is how many bytes of the checksum of a binary are used in its archived name
+	archiveChecksumLength = 8
+)
+
+// archivedBinary is a binary in the archive directory
+type archivedBinary struct {
+	path     string
+	checksum []byte
+	modTime  int64
+}
+
+// archive copies the binary of this process to the archive directory, named after its generation and its checksum since
+// generations start over on a cold start, unless it is the same as the last archived one. Only the latest MaxArchived
+// binaries are kept.
+func (s *Supervisor) archive() error {
+	if err := os.MkdirAll(s.config.ArchiveDir, 0755); err != nil {
+		return fmt.Errorf("could not create archive directory: %v", err)
+	}
+
+	binaries, err := s.archived()
+	if err != nil {
+		return err
+	}
+	checksum, err := fileChecksum(selfExecutable)
+	if err != nil {
+		return err
+	}
+	if len(binaries) > 0 && bytes.Equal(binaries[0].checksum, checksum) {
+		return nil
+	}
+
+	name := archivePrefix + strconv.Itoa(s.generation) + "-" + hex.EncodeToString(checksum[:archiveChecksumLength])
+	path := filepath.Join(s.config.ArchiveDir, name)
+	if err := copyFile(selfExecutable, path, 0755); err != nil {
+		return fmt.Errorf("could not archive binary: %v", err)
+	}
+	if executable, err := s.selfPath(); err == nil {
+		if _, err := os.Stat(executable + SignatureSuffix); err == nil {
+			if err := copyFile(executable+SignatureSuffix, path+SignatureSuffix, 0644); err != nil {
+				return fmt.Errorf("could not archive signature: %v", err)
+			}
+		}
+	}
+	log.Printf("archived binary of generation %d", s.generation)
+
+	binaries, err = s.archived()
+	if err != nil {
+		return err
+	}
+	for i := s.config.MaxArchived; i < len(binaries); i++ {
+		_ = os.Remove(binaries[i].path)
+		_ = os.Remove(binaries[i].path + SignatureSuffix)
+	}
+	return nil
+}
+
+// archived returns the archived binaries, most recently archived first
+func (s *Supervisor) archived() ([]archivedBinary, error) {
+	entries, err := ioutil.ReadDir(s.config.ArchiveDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read archive: %v", err)
+	}
+
+	var binaries []archivedBinary
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() || !isArchivedName(fi.Name()) {
+			continue
+		}
+
+		path := filepath.Join(s.config.ArchiveDir, fi.Name())
+		checksum, err := fileChecksum(path)
+		if err != nil {
+			return nil, err
+		}
+		binaries = append(binaries, archivedBinary{path: path, checksum: checksum, modTime: fi.ModTime().UnixNano()})
+	}
+	sort.SliceStable(binaries, func(i, j int) bool {
+		return binaries[i].modTime > binaries[j].modTime
+	})
+	return binaries, nil
+}
+
+// previousBinary returns the most recently archived binary which is different from the one currently running, or
+// from the one the workers run in master/worker mode
+func (s *Supervisor) previousBinary() (string, error) {
+	if s.config.ArchiveDir == "" {
+		return "", fmt.Errorf("no archive directory configured")
+	}
+
+	current := selfExecutable
+	if s.IsMaster() {
+		var err error
+		if current, err = s.executablePath(); err != nil {
+			return "", err
+		}
+	}
+	checksum, err := fileChecksum(current)
+	if err != nil {
+		return "", err
+	}
+
+	binaries, err := s.archived()
+	if err != nil {
+		return "", err
+	}
+	for _, b := range binaries {
+		if !bytes.Equal(b.checksum, checksum) {
+			return b.path, nil
+		}
+	}
+	return "", fmt.Errorf("no previous binary archived")
+}
+
+// Rollback restarts the process, or replaces the workers in master/worker mode, running the previous archived binary
+func (s *Supervisor) Rollback() error {
+	path, err := s.previousBinary()
+	if err != nil {
+		return err
+	}
+	log.Printf("rolling back to %s", path)
+	return s.upgrade(path)
+}
+
+// RollbackHandler returns an HTTP handler which rolls back to the previous binary on a POST request, to be used in an
+// admin listener
+func (s *Supervisor) RollbackHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := s.Rollback(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, "rollback requested")
+	})
+}
+
+// isArchivedName returns whether the given file name is the one of an archived binary, binary-<generation>-<checksum>
+func isArchivedName(name string) bool {
+	parts := strings.SplitN(strings.TrimPrefix(name, archivePrefix), "-", 2)
+	if len(parts) != 2 || !strings.HasPrefix(name, archivePrefix) {
+		return false
+	}
+	if _, err := strconv.Atoi(parts[0]); err != nil {
+		return false
+	}
+	checksum, err := hex.DecodeString(parts[1])
+	return err == nil && len(checksum) == archiveChecksumLength
+}
+
+func fileChecksum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read binary: %v", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("could not read binary: %v", err)
+	}
+	return h.Sum(nil), nil
+}
+
+// copyFile atomically copies a file, writing to a temporary file which is then renamed
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	_, err = io.Copy(tmp, in)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
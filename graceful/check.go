@@ -0,0 +1,67 @@
+package graceful
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// check runs the given binary in check mode, where it validates the snapshot just taken instead of serving, and
+// returns an error if it fails or does not finish before the ready timeout
+func (s *Supervisor) check(executable *os.File) error {
+	if s.config.Check == nil && s.config.Restore == nil {
+		return nil
+	}
+
+	env, err := handoff{
+		Generation:   s.generation + 1,
+		ParentPID:    os.Getpid(),
+		Snapshot:     s.config.SnapshotLocation,
+		Check:        true,
+		ExecutableFD: readyFileDescriptor,
+	}.env()
+	if err != nil {
+		return fmt.Errorf("could not encode handoff: %v", err)
+	}
+
+	cmd := execCommand(executable, readyFileDescriptor)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(workerEnviron(), env)
+	cmd.ExtraFiles = []*os.File{executable}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to launch snapshot check: %v", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-exited:
+		if err != nil {
+			return fmt.Errorf("snapshot check failed: %v", err)
+		}
+		return nil
+	case <-time.After(s.config.ReadyTimeout):
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("snapshot check not finished after %s", s.config.ReadyTimeout)
+	}
+}
+
+// runCheck validates the snapshot handed over by the parent process and exits, with a non-zero status if it is not
+// valid
+func (s *Supervisor) runCheck() {
+	validate := s.config.Check
+	if validate == nil {
+		validate = s.config.Restore
+	}
+
+	if err := validate(s.handoff.Snapshot); err != nil {
+		log.Printf("snapshot %s is not valid: %v", s.handoff.Snapshot, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,56 @@
+package graceful
+
+import (
+	"log"
+	"time"
+)
+
+// Checkpoint requests a background snapshot, for instance after a number of commands, without waiting for it
+func (s *Supervisor) Checkpoint() {
+	select {
+	case s.checkpoints <- struct{}{}:
+	default:
+	}
+}
+
+// runCheckpoints takes background snapshots every SnapshotInterval and when requested with Checkpoint. When there is
+// more than one worker, the primary one also saves refresh snapshots every RefreshInterval for the other workers to
+// restore.
+func (s *Supervisor) runCheckpoints() {
+	var tick, refresh <-chan time.Time
+	if s.config.SnapshotInterval > 0 {
+		ticker := time.NewTicker(s.config.SnapshotInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	if s.isWorker() && s.config.Workers > 1 {
+		ticker := time.NewTicker(s.config.RefreshInterval)
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
+
+	for {
+		location := s.config.SnapshotLocation
+		select {
+		case <-tick:
+		case <-s.checkpoints:
+		case <-refresh:
+			location = s.config.RefreshLocation
+		}
+		if err := s.checkpoint(location); err != nil {
+			log.Printf("could not take background snapshot: %v", err)
+		}
+	}
+}
+
+// checkpoint takes a snapshot in the given location without stopping the work, unless it is already stopped for a
+// restart. The Snapshot function is responsible for saving a consistent state.
+func (s *Supervisor) checkpoint(location string) error {
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+
+	if s.paused {
+		return nil
+	}
+	return s.saveSnapshot(location)
+}
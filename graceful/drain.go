@@ -0,0 +1,84 @@
+package graceful
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DrainReport describes how the connections of a stopping process were closed
+type DrainReport struct {
+	// Drained is the number of connections which were closed cleanly, either idle or after finishing their requests
+	Drained int
+	// CutOff is the number of connections which were still active after the drain timeout and were forcibly closed
+	CutOff int
+	// Duration is how long draining took
+	Duration time.Duration
+}
+
+// drain stops accepting connections, closes the idle ones and waits for the active ones to finish until the drain
+// timeout, when the remaining ones are forcibly closed
+func (s *Supervisor) drain() DrainReport {
+	start := time.Now()
+	active := s.activeConnections()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.DrainTimeout)
+	defer cancel()
+
+	servers := s.servers()
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server *http.Server) {
+			errs[i] = server.Shutdown(ctx)
+			wg.Done()
+		}(i, server)
+	}
+	wg.Wait()
+
+	cutOff := s.activeConnections()
+	for i, server := range servers {
+		if errs[i] != nil {
+			_ = server.Close()
+		}
+	}
+
+	report := DrainReport{
+		Drained:  active - cutOff,
+		CutOff:   cutOff,
+		Duration: time.Since(start),
+	}
+	if report.Drained < 0 {
+		report.Drained = 0
+	}
+
+	log.Printf("drained %d connections in %s, %d cut off", report.Drained, report.Duration, report.CutOff)
+	if s.config.Hooks.AfterDrain != nil {
+		s.config.Hooks.AfterDrain(report)
+	}
+	return report
+}
+
+func (s *Supervisor) activeConnections() int {
+	var active int
+	for _, l := range s.listeners {
+		active += l.activeConnections()
+	}
+	return active
+}
+
+// servers returns the distinct servers of all the listeners
+func (s *Supervisor) servers() []*http.Server {
+	var servers []*http.Server
+	seen := make(map[*http.Server]bool)
+	for _, l := range s.config.Listeners {
+		if !seen[l.Server] {
+			seen[l.Server] = true
+			servers = append(servers, l.Server)
+		}
+	}
+	return servers
+}
@@ -0,0 +1,137 @@
+package graceful
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// selfExecutable is the binary of the current process, which can be read even if its path was replaced or removed
+const selfExecutable = "/proc/self/exe"
+
+// executablePath returns the path of the binary to start on a restart: the one requested with Upgrade, the configured
+// one or the executable of the current process, resolved through /proc/self/exe so it does not depend on the working
+// directory or on how the process was started. A replaced executable resolves to the binary now at its path.
+func (s *Supervisor) executablePath() (string, error) {
+	path := s.binary
+	if path == "" {
+		path = s.config.Executable
+	}
+	if path == "" {
+		var err error
+		path, err = s.selfPath()
+		if err != nil {
+			return "", fmt.Errorf("could not resolve executable: %v", err)
+		}
+	}
+	return path, nil
+}
+
+// selfPath returns the path of the binary the current process was started from. A process started from a verified
+// binary runs a private copy of it, so the path of the original binary is passed in the handoff.
+func (s *Supervisor) selfPath() (string, error) {
+	if s.handoff != nil && s.handoff.Executable != "" {
+		return s.handoff.Executable, nil
+	}
+	return os.Executable()
+}
+
+// executable opens and verifies the binary to start on a restart, which must be closed once started
+func (s *Supervisor) executable() (*os.File, error) {
+	path, err := s.executablePath()
+	if err != nil {
+		return nil, err
+	}
+	return s.verify(path)
+}
+
+// execCommand returns a command which runs the opened binary with the arguments of this process. The binary must be
+// passed to the child process as the extra file with the given file descriptor, and it is executed through
+// /proc/self/fd, so the child runs the file which was opened and verified rather than whatever is at its path by then.
+// The binary keeps the name of the original file, which is also the first argument.
+func execCommand(executable *os.File, fd int) *exec.Cmd {
+	cmd := exec.Command("/proc/self/fd/"+strconv.Itoa(fd), os.Args[1:]...)
+	cmd.Args[0] = executable.Name()
+	return cmd
+}
+
+// Upgrade restarts the process, or replaces the workers in master/worker mode, running the binary at the given path
+// instead of the usual one. It is refused unless a Verification is configured, so only trusted binaries can be
+// requested.
+func (s *Supervisor) Upgrade(path string) error {
+	if !s.config.Verification.enabled() {
+		return fmt.Errorf("upgrades are refused without binary verification")
+	}
+	return s.upgrade(path)
+}
+
+// upgrade restarts the process running the binary at the given path, which is verified if a Verification is configured
+func (s *Supervisor) upgrade(path string) error {
+	path, err := checkExecutable(path)
+	if err != nil {
+		return err
+	}
+	f, err := s.verify(path)
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	if s.isWorker() {
+		if s.control == nil {
+			return fmt.Errorf("not ready")
+		}
+		s.reply(messageUpgrade + " " + path)
+		return nil
+	}
+
+	select {
+	case s.upgrades <- path:
+		return nil
+	default:
+		return fmt.Errorf("an upgrade is already in progress")
+	}
+}
+
+// UpgradeHandler returns an HTTP handler which upgrades to the binary in the "binary" parameter of a POST request, to
+// be used in an admin listener
+func (s *Supervisor) UpgradeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := s.Upgrade(r.FormValue("binary")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, "upgrade requested")
+	})
+}
+
+// checkExecutable returns the absolute path of the binary at the given path, or an error if it is not an executable
+// file
+func checkExecutable(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("no binary given")
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve binary path: %v", err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read binary: %v", err)
+	}
+	if !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+		return "", fmt.Errorf("%s is not an executable file", path)
+	}
+	return path, nil
+}
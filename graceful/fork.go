@@ -0,0 +1,90 @@
+package graceful
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const readyMessage = 1
+
+// startFork starts a new process from the given binary which inherits the listening sockets and a pipe to notify its
+// readiness, and waits until it is ready, returning its PID. If it exits or is not ready before the timeout, it is
+// killed.
+func (s *Supervisor) startFork(executable *os.File, timing *restartTiming) (int, error) {
+	files, listeners, err := s.listenerFiles()
+	if err != nil {
+		return 0, err
+	}
+	defer closeFiles(files)
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, fmt.Errorf("could not create readiness pipe: %v", err)
+	}
+	defer readyReader.Close()
+
+	extraFiles := append([]*os.File{readyWriter}, files...)
+	h := handoff{
+		Generation: s.generation + 1,
+		ParentPID:  os.Getpid(),
+		Snapshot:   s.config.SnapshotLocation,
+		ReadyFD:    readyFileDescriptor,
+		Listeners:  listeners,
+		Restart:    timing,
+	}
+	if s.pidFile != nil {
+		h.PIDLockFD = readyFileDescriptor + len(extraFiles)
+		extraFiles = append(extraFiles, s.pidFile.lock)
+	}
+	h.ExecutableFD = readyFileDescriptor + len(extraFiles)
+	h.Executable = executable.Name()
+	extraFiles = append(extraFiles, executable)
+	env, err := h.env()
+	if err != nil {
+		readyWriter.Close()
+		return 0, fmt.Errorf("could not encode handoff: %v", err)
+	}
+
+	cmd := execCommand(executable, h.ExecutableFD)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), env)
+	cmd.ExtraFiles = extraFiles
+
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to launch new process: %v", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := readyReader.Read(b)
+		if err == nil && b[0] != readyMessage {
+			err = fmt.Errorf("unexpected readiness message %d", b[0])
+		}
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+		if err == nil {
+			return cmd.Process.Pid, nil
+		}
+		err = fmt.Errorf("new process %d did not notify readiness: %v", cmd.Process.Pid, err)
+	case err = <-exited:
+		return 0, fmt.Errorf("new process %d exited before being ready: %v", cmd.Process.Pid, err)
+	case <-time.After(s.config.ReadyTimeout):
+		err = fmt.Errorf("new process %d not ready after %s", cmd.Process.Pid, s.config.ReadyTimeout)
+	}
+
+	_ = cmd.Process.Kill()
+	return 0, err
+}
@@ -0,0 +1,79 @@
+package graceful
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+const handoffEnv = "GRACEFUL_HANDOFF"
+
+// handoff is the restart state passed from a process to its child in the handoff environment variable, so the child
+// is started with exactly the same arguments as the first process, no matter how many restarts happened before
+type handoff struct {
+	// Generation is the number of restarts since the first process, which is generation 1
+	Generation int `json:"generation"`
+	// ParentPID is the PID of the process which started the child
+	ParentPID int `json:"parent_pid"`
+	// Snapshot is the location of the snapshot taken by the parent process
+	Snapshot string `json:"snapshot"`
+	// ReadyFD is the file descriptor of the pipe used to notify readiness to the parent process
+	ReadyFD int `json:"ready_fd"`
+	// Listeners are the sockets inherited from the parent process
+	Listeners []inheritedListener `json:"listeners"`
+	// PIDLockFD is the file descriptor of the locked PID lock file, or 0 if there is no PID file
+	PIDLockFD int `json:"pid_lock_fd,omitempty"`
+	// Worker is whether the child is a worker started by a master process
+	Worker bool `json:"worker,omitempty"`
+	// WorkerIndex is the position of the worker in the master, 0 being the primary worker
+	WorkerIndex int `json:"worker_index,omitempty"`
+	// Check is whether the child only has to validate the snapshot and exit, before the actual restart
+	Check bool `json:"check,omitempty"`
+	// ControlFD is the file descriptor of the socket used to communicate with the master process, for workers
+	ControlFD int `json:"control_fd,omitempty"`
+	// ExecutableFD is the file descriptor of the binary the child was executed from, which it closes
+	ExecutableFD int `json:"executable_fd,omitempty"`
+	// Executable is the path of the binary the child was executed from, which may be a private copy of it
+	Executable string `json:"executable,omitempty"`
+	// Restart is the timing of the restart which started the child so far, or nil if it was not started by a restart
+	Restart *restartTiming `json:"restart,omitempty"`
+}
+
+// restartTiming is when a restart was requested and how long the snapshot took, so the new process can report the
+// latency of the whole restart
+type restartTiming struct {
+	Start    time.Time     `json:"start"`
+	Snapshot time.Duration `json:"snapshot"`
+}
+
+// readHandoff returns the handoff from the parent process, or nil if this process was not started by a restart.
+// The environment variable is unset so it is not inherited by other processes started by the application, and it is
+// ignored if it was not set by the parent process.
+func readHandoff() *handoff {
+	value, ok := os.LookupEnv(handoffEnv)
+	if !ok {
+		return nil
+	}
+	_ = os.Unsetenv(handoffEnv)
+
+	var h handoff
+	if err := json.Unmarshal([]byte(value), &h); err != nil {
+		log.Printf("ignoring invalid %s: %v", handoffEnv, err)
+		return nil
+	}
+	if h.ParentPID != os.Getppid() {
+		log.Printf("ignoring %s from process %d, which is not the parent process", handoffEnv, h.ParentPID)
+		return nil
+	}
+	return &h
+}
+
+// env returns the environment variable to pass the handoff to a child process
+func (h handoff) env() (string, error) {
+	value, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	return handoffEnv + "=" + string(value), nil
+}
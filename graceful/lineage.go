@@ -0,0 +1,151 @@
+package graceful
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/rogerclotet/cqrs/argument"
+	"github.com/rogerclotet/cqrs/query"
+)
+
+const (
+	// LineageQueryName is the name of the built-in query which responds with the process lineage
+	LineageQueryName = "lineage"
+
+	lineageSuffix = ".lineage"
+	maxAncestors  = 10
+)
+
+// Process describes a process in the restart lineage
+type Process struct {
+	// Generation is the number of restarts since the first process, which is generation 1
+	Generation int `json:"generation"`
+	PID        int `json:"pid"`
+	ParentPID  int `json:"parent_pid"`
+	// StartTime is when the process started
+	StartTime time.Time `json:"start_time"`
+	// Executable is the path of the binary the process was started from
+	Executable string `json:"executable"`
+	// Restart is the latency of the restart which started the process, or nil if it was not started by a restart
+	Restart *RestartLatency `json:"restart,omitempty"`
+}
+
+// RestartLatency is how long a restart took, in nanoseconds when encoded as JSON
+type RestartLatency struct {
+	// Total is the time from the restart request until the new process was ready
+	Total time.Duration `json:"total_ns"`
+	// Snapshot is how long the previous process took to save the snapshot
+	Snapshot time.Duration `json:"snapshot_ns"`
+	// Restore is how long the new process took to restore the snapshot
+	Restore time.Duration `json:"restore_ns"`
+}
+
+// Lineage is the current process along with the processes it replaced
+type Lineage struct {
+	Process
+	// Ancestors are the previous processes, most recent first, including the ones before the last shutdown
+	Ancestors []Process `json:"ancestors"`
+}
+
+// String returns the lineage encoded as JSON
+func (l Lineage) String() string {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+func (s *Supervisor) currentProcess() Process {
+	executable, err := s.selfPath()
+	if err != nil {
+		executable = os.Args[0]
+	}
+
+	return Process{
+		Generation: s.generation,
+		PID:        os.Getpid(),
+		ParentPID:  os.Getppid(),
+		StartTime:  time.Now(),
+		Executable: executable,
+	}
+}
+
+// Lineage returns the lineage of the current process
+func (s *Supervisor) Lineage() Lineage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.lineage
+}
+
+// LineageQuery returns the built-in lineage query, to be registered in a query.Registry
+func (s *Supervisor) LineageQuery() query.RegisteredQuery {
+	return query.NewRegisteredQuery(LineageQueryName, func(_ context.Context, _ argument.Arguments) (interface{}, error) {
+		return s.Lineage(), nil
+	})
+}
+
+// LineageHandler returns an HTTP handler which responds with the process lineage as JSON, to be used in an admin
+// listener
+func (s *Supervisor) LineageHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.Lineage())
+	})
+}
+
+// restoreLineage adds the processes in the lineage saved alongside the snapshot at the given location as ancestors
+func (s *Supervisor) restoreLineage(location string) error {
+	b, err := ioutil.ReadFile(s.lineageFile(location))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read lineage: %v", err)
+	}
+
+	var previous Lineage
+	if err := json.Unmarshal(b, &previous); err != nil {
+		return fmt.Errorf("could not decode lineage: %v", err)
+	}
+
+	ancestors := append([]Process{previous.Process}, previous.Ancestors...)
+	if len(ancestors) > maxAncestors {
+		ancestors = ancestors[:maxAncestors]
+	}
+	s.mu.Lock()
+	s.lineage.Ancestors = ancestors
+	s.mu.Unlock()
+	return nil
+}
+
+// saveLineage saves the lineage alongside the snapshot at the given location
+func (s *Supervisor) saveLineage(location string) error {
+	b, err := json.Marshal(s.Lineage())
+	if err != nil {
+		return fmt.Errorf("could not encode lineage: %v", err)
+	}
+
+	path := s.lineageFile(location)
+	if err := ioutil.WriteFile(path+".tmp", b, 0644); err != nil {
+		return fmt.Errorf("could not write lineage: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("could not write lineage: %v", err)
+	}
+	return nil
+}
+
+// lineageFile returns the path of the lineage file saved alongside the snapshot at the given location
+func (s *Supervisor) lineageFile(location string) string {
+	if s.config.LineageFile != "" {
+		return s.config.LineageFile
+	}
+	return location + lineageSuffix
+}
@@ -0,0 +1,110 @@
+package graceful
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+type gracefulListener struct {
+	// active is the number of open connections, accessed atomically
+	active int64
+
+	net.Listener
+	stop chan error
+
+	// socketPath is the Unix socket path to remove on shutdown, if any
+	socketPath string
+	// certificate is the TLS certificate served on this listener, if any
+	certificate *certificate
+}
+
+func newGracefulListener(l net.Listener) (gl *gracefulListener) {
+	gl = &gracefulListener{Listener: l, stop: make(chan error)}
+	go func() {
+		_ = <-gl.stop
+		gl.stop <- gl.Listener.Close()
+	}()
+	return
+}
+
+func (gl *gracefulListener) Accept() (net.Conn, error) {
+	c, err := gl.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+
+	c = &gracefulConnection{Conn: c, listener: gl}
+
+	atomic.AddInt64(&gl.active, 1)
+	return c, err
+}
+
+func (gl *gracefulListener) Close() error {
+	gl.stop <- nil
+	return <-gl.stop
+}
+
+// removeSocket removes the Unix socket path, if any. It must only be called on a real shutdown, since the socket is
+// shared with any child process.
+func (gl *gracefulListener) removeSocket() error {
+	if gl.socketPath == "" {
+		return nil
+	}
+
+	err := os.Remove(gl.socketPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove socket %s: %v", gl.socketPath, err)
+	}
+	return nil
+}
+
+// File returns a duplicate of the listener file descriptor, to be inherited by a child process.
+// The descriptor is duplicated through the raw connection instead of using TCPListener.File, because passing that file
+// to a child process would put the shared socket in blocking mode, and this process could not stop accepting.
+func (gl *gracefulListener) File() (*os.File, error) {
+	sc, ok := gl.Listener.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("unsupported listener type %T", gl.Listener)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("could not get file descriptor for socket: %v", err)
+	}
+
+	var fd int
+	var dupErr error
+	err = raw.Control(func(s uintptr) {
+		fd, dupErr = syscall.Dup(int(s))
+	})
+	if err == nil {
+		err = dupErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not duplicate file descriptor for socket: %v", err)
+	}
+	syscall.CloseOnExec(fd)
+
+	return os.NewFile(uintptr(fd), gl.Addr().String()), nil
+}
+
+// activeConnections returns the number of connections accepted by the listener which are still open
+func (gl *gracefulListener) activeConnections() int {
+	return int(atomic.LoadInt64(&gl.active))
+}
+
+type gracefulConnection struct {
+	net.Conn
+	listener *gracefulListener
+	once     sync.Once
+}
+
+func (w *gracefulConnection) Close() error {
+	w.once.Do(func() {
+		atomic.AddInt64(&w.listener.active, -1)
+	})
+	return w.Conn.Close()
+}
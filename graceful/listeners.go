@@ -0,0 +1,220 @@
+package graceful
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+)
+
+const firstListenerFileDescriptor = readyFileDescriptor + 1
+
+// Listener is the configuration of a named listener, which is inherited by name across restarts
+type Listener struct {
+	// Name identifies the listener across restarts, and matches the systemd LISTEN_FDNAMES entry
+	Name string
+	// Network is the network to listen to, "tcp" by default. Use "unix" for Unix stream sockets.
+	Network string
+	// Addr is the address to listen to when the listener is not inherited. Unix socket addresses starting with '@'
+	// are in the abstract namespace.
+	Addr string
+	// Server is the HTTP server used to serve requests on this listener
+	Server *http.Server
+	// TLS enables TLS on this listener when set
+	TLS *TLS
+	// PrimaryOnly makes only the primary worker serve this listener, for requests which must be handled by the
+	// process owning the application state
+	PrimaryOnly bool
+}
+
+// inheritedListener describes a listener passed to the child process in the handoff
+type inheritedListener struct {
+	Name    string `json:"name"`
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+	FD      int    `json:"fd"`
+}
+
+type inheritedFile struct {
+	file          *os.File
+	network, addr string
+}
+
+// socketPath returns the Unix socket path of an inherited socket created by a previous process, if any
+func (f inheritedFile) socketPath() string {
+	if f.network == "unix" && f.addr != "" && !isAbstract(f.addr) {
+		return f.addr
+	}
+	return ""
+}
+
+// inheritedFiles returns the sockets inherited from the parent process or from systemd, indexed by name.
+// Sockets from systemd have no address, since they are configured in the socket unit.
+func (s *Supervisor) inheritedFiles() map[string]inheritedFile {
+	files := make(map[string]inheritedFile)
+	if s.handoff == nil {
+		for _, f := range systemdFiles() {
+			files[f.Name()] = inheritedFile{file: f}
+		}
+		return files
+	}
+
+	for _, l := range s.handoff.Listeners {
+		files[l.Name] = inheritedFile{
+			file:    os.NewFile(uintptr(l.FD), l.Name),
+			network: l.Network,
+			addr:    l.Addr,
+		}
+	}
+	return files
+}
+
+// listen creates the configured listeners, using the inherited sockets with the same name and address when available.
+// Inherited sockets which are no longer configured are closed, but their Unix socket paths are still served by the
+// parent process, so they are only removed once this process is ready.
+func (s *Supervisor) listen() error {
+	files := s.inheritedFiles()
+	defer func() {
+		for name, f := range files {
+			log.Printf("closing inherited listener %s, which is no longer configured", name)
+			s.closeInherited(f)
+		}
+	}()
+
+	for _, c := range s.config.Listeners {
+		f, ok := files[c.Name]
+		delete(files, c.Name)
+
+		var l net.Listener
+		var err error
+		systemd := ok && f.addr == ""
+		if ok && (systemd || f.network == c.Network && f.addr == c.Addr) {
+			l, err = net.FileListener(f.file)
+			f.file.Close()
+			if err != nil {
+				return fmt.Errorf("could not listen to inherited socket %s: %v", c.Name, err)
+			}
+		} else {
+			if ok {
+				s.closeInherited(f)
+			}
+			l, err = listen(c.Network, c.Addr)
+			if err != nil {
+				return fmt.Errorf("could not listen to %s address %s for %s: %v", c.Network, c.Addr, c.Name, err)
+			}
+		}
+
+		gl := newGracefulListener(l)
+		if c.TLS != nil {
+			gl.certificate, err = newCertificate(*c.TLS)
+			if err != nil {
+				l.Close()
+				return err
+			}
+			c.Server.TLSConfig = gl.certificate.tlsConfig(c.Server.TLSConfig)
+		}
+		if ul, ok := l.(*net.UnixListener); ok {
+			// The socket path must survive restarts, so it is only removed on shutdown, and never when it is owned
+			// by systemd or by a master process
+			ul.SetUnlinkOnClose(false)
+			if !systemd && !s.isWorker() && !isAbstract(c.Addr) {
+				gl.socketPath = c.Addr
+			}
+		}
+		s.listeners = append(s.listeners, gl)
+	}
+	return nil
+}
+
+// closeInherited closes an inherited socket which is not used anymore, and records its Unix socket path to be removed
+// once this process is ready. The paths of a master process are left to it.
+func (s *Supervisor) closeInherited(f inheritedFile) {
+	f.file.Close()
+	if path := f.socketPath(); path != "" && !s.isWorker() {
+		s.removedSockets = append(s.removedSockets, path)
+	}
+}
+
+// removeSockets removes the Unix socket paths of the inherited sockets which are not used anymore, unless they are
+// used again by a configured listener. It must only be called once the parent process has handed off to this one.
+func (s *Supervisor) removeSockets() {
+	for _, path := range s.removedSockets {
+		used := false
+		for _, c := range s.config.Listeners {
+			used = used || c.Network == "unix" && c.Addr == path
+		}
+		if used {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("could not remove socket %s: %v", path, err)
+		}
+	}
+	s.removedSockets = nil
+}
+
+// listen creates a new listener. A Unix socket left behind by a process which did not shut down cleanly is removed.
+func listen(network, addr string) (net.Listener, error) {
+	l, err := net.Listen(network, addr)
+	if err != nil && network == "unix" && removeStaleSocket(addr) {
+		l, err = net.Listen(network, addr)
+	}
+	return l, err
+}
+
+// removeStaleSocket removes the Unix socket at the given path if nothing is listening to it, and returns whether it
+// was removed
+func removeStaleSocket(path string) bool {
+	if isAbstract(path) {
+		return false
+	}
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return false
+	}
+
+	log.Printf("removing stale socket %s", path)
+	return os.Remove(path) == nil
+}
+
+// isAbstract returns whether a Unix socket address is in the abstract namespace, which has no path in the filesystem
+func isAbstract(addr string) bool {
+	return len(addr) > 0 && addr[0] == '@'
+}
+
+// listenerFiles returns the files to be inherited by a child process, and their description for the handoff
+func (s *Supervisor) listenerFiles() ([]*os.File, []inheritedListener, error) {
+	var files []*os.File
+	var listeners []inheritedListener
+	for i, l := range s.listeners {
+		f, err := l.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, nil, err
+		}
+		files = append(files, f)
+
+		c := s.config.Listeners[i]
+		listeners = append(listeners, inheritedListener{
+			Name:    c.Name,
+			Network: c.Network,
+			Addr:    c.Addr,
+			FD:      firstListenerFileDescriptor + i,
+		})
+	}
+
+	return files, listeners, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
@@ -0,0 +1,546 @@
+package graceful
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Messages exchanged between the master and its workers through the control socket
+const (
+	messageReady       = "ready"
+	messageSnapshot    = "snapshot"
+	messageSnapshotted = "snapshotted"
+	messageResume      = "resume"
+	messageStop        = "stop"
+	messageShutdown    = "shutdown"
+	messageError       = "error"
+	messageUpgrade     = "upgrade"
+
+	// workerRestartDelay is how long to wait before restarting a worker which crashed again soon after a restart,
+	// doubled on every crash up to maxWorkerRestartDelay
+	workerRestartDelay    = time.Second
+	maxWorkerRestartDelay = 30 * time.Second
+
+	// maxPendingMessages is how many messages from a worker are kept until they are waited for
+	maxPendingMessages = 16
+)
+
+// worker is a worker process started by the master
+type worker struct {
+	index    int
+	cmd      *exec.Cmd
+	started  time.Time
+	control  net.Conn
+	messages chan string
+	// requests is the number of requests sent to the worker, which identifies their replies
+	requests int
+	// upgrades receives the binaries of the upgrades requested by the worker
+	upgrades chan<- string
+	// done is closed when the process exits, after setting err
+	done chan struct{}
+	err  error
+}
+
+// IsMaster returns whether this process is a master, which owns the listeners and runs the application in worker
+// processes instead of serving requests itself
+func (s *Supervisor) IsMaster() bool {
+	return s.config.Master && !s.isWorker()
+}
+
+func (s *Supervisor) isWorker() bool {
+	return s.handoff != nil && s.handoff.Worker
+}
+
+// Primary returns whether this process owns the application state: it is the only one which handles commands and
+// takes snapshots. Only the first worker is primary in master/worker mode, and other processes always are.
+func (s *Supervisor) Primary() bool {
+	return !s.isWorker() || s.handoff.WorkerIndex == 0
+}
+
+// RunMaster starts the worker processes and keeps them running until the master receives SIGINT or SIGTERM. Workers
+// are replaced on SIGHUP, the primary one handing over its snapshot, and restarted if they exit unexpectedly. SIGUSR1
+// is forwarded to the workers. Workers are also replaced when a watched file changes, and when one of them requests an
+// upgrade, in which case the new binary is used for all the workers from then on. SIGUSR2 rolls the workers back to
+// the previous archived binary. Listen must be called before.
+func (s *Supervisor) RunMaster() error {
+	if len(s.listeners) == 0 {
+		return fmt.Errorf("not listening")
+	}
+
+	changes, err := s.watch()
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	restart := make(chan os.Signal, 1)
+	signal.Notify(restart, syscall.SIGHUP)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGUSR1)
+	rollback := make(chan os.Signal, 1)
+	signal.Notify(rollback, syscall.SIGUSR2)
+	if changes != nil {
+		go func() {
+			for range changes {
+				log.Print("watched files changed, replacing workers")
+				restart <- syscall.SIGHUP
+			}
+		}()
+	}
+
+	workers := make([]*worker, s.config.Workers)
+	exits := make(chan *worker, s.config.Workers)
+	// respawns receives the workers which exited unexpectedly once it is time to restart them, and delays are how
+	// long to wait before the next restart of each worker
+	respawns := make(chan *worker, s.config.Workers)
+	delays := make([]time.Duration, s.config.Workers)
+	scheduleRespawn := func(w *worker) {
+		delay := delays[w.index]
+		delays[w.index] = nextRestartDelay(delay)
+		time.AfterFunc(delay, func() {
+			respawns <- w
+		})
+	}
+	start := func(index int) error {
+		executable, err := s.executable()
+		if err != nil {
+			return err
+		}
+		defer executable.Close()
+
+		w, err := s.startWorker(index, executable, nil)
+		if err != nil {
+			return err
+		}
+		workers[index] = w
+		go func() {
+			<-w.done
+			exits <- w
+		}()
+		return nil
+	}
+
+	// replaceAll replaces the primary worker first, so the other ones restore its latest snapshot, and returns whether
+	// it was replaced
+	replaceAll := func() bool {
+		logNotify("RELOADING=1")
+		defer logNotify("READY=1")
+
+		for i, w := range workers {
+			replacement, err := s.replaceWorker(w)
+			if err != nil {
+				log.Printf("could not replace worker %d, still using it: %v", w.cmd.Process.Pid, err)
+				if i == 0 {
+					return false
+				}
+				continue
+			}
+			workers[i] = replacement
+			go func() {
+				<-replacement.done
+				exits <- replacement
+			}()
+		}
+		return true
+	}
+
+	for i := range workers {
+		if err := start(i); err != nil {
+			for _, w := range workers[:i] {
+				w.shutdown(s.config.DrainTimeout + s.config.ReadyTimeout)
+			}
+			return err
+		}
+	}
+	logNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+
+	for {
+		select {
+		case <-stop:
+			logNotify("STOPPING=1")
+			// The primary worker is shut down last, so its final snapshot includes all the commands forwarded to it
+			for i := len(workers) - 1; i >= 0; i-- {
+				workers[i].shutdown(s.config.DrainTimeout + s.config.ReadyTimeout)
+			}
+			return s.cleanUp()
+		case <-reload:
+			for _, w := range workers {
+				_ = w.cmd.Process.Signal(syscall.SIGUSR1)
+			}
+		case <-restart:
+			replaceAll()
+		case <-rollback:
+			if err := s.Rollback(); err != nil {
+				log.Printf("could not roll back: %v", err)
+			}
+		case path := <-s.upgrades:
+			log.Printf("upgrading workers to %s", path)
+			previous := s.binary
+			s.binary = path
+			if !replaceAll() {
+				s.binary = previous
+			}
+		case w := <-exits:
+			if workers[w.index] != w {
+				continue
+			}
+			log.Printf("worker %d exited unexpectedly: %v", w.cmd.Process.Pid, w.err)
+			if time.Since(w.started) > maxWorkerRestartDelay {
+				delays[w.index] = 0
+			}
+			scheduleRespawn(w)
+		case w := <-respawns:
+			if workers[w.index] != w {
+				// It was replaced in the meantime
+				continue
+			}
+			if err := start(w.index); err != nil {
+				log.Printf("could not restart worker, retrying in %s: %v", delays[w.index], err)
+				scheduleRespawn(w)
+			}
+		}
+	}
+}
+
+// nextRestartDelay returns how long to wait before restarting a worker after waiting the given delay
+func nextRestartDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return workerRestartDelay
+	}
+	if delay *= 2; delay > maxWorkerRestartDelay {
+		return maxWorkerRestartDelay
+	}
+	return delay
+}
+
+// replaceWorker makes the current worker take a snapshot if it is the primary one, checks that the new binary can
+// restore it, and starts a new worker which restores it. The old worker is then stopped, or resumed if the new one
+// could not be started.
+func (s *Supervisor) replaceWorker(old *worker) (*worker, error) {
+	timing := &restartTiming{Start: time.Now()}
+	executable, err := s.executable()
+	if err != nil {
+		return nil, err
+	}
+	defer executable.Close()
+
+	if old.index == 0 {
+		if err := old.request(messageSnapshot, messageSnapshotted, s.config.ReadyTimeout); err != nil {
+			_ = old.send(messageResume)
+			return nil, fmt.Errorf("could not take snapshot: %v", err)
+		}
+		timing.Snapshot = time.Since(timing.Start)
+
+		if err := s.check(executable); err != nil {
+			_ = old.send(messageResume)
+			return nil, err
+		}
+	}
+
+	w, err := s.startWorker(old.index, executable, timing)
+	if err != nil {
+		_ = old.send(messageResume)
+		return nil, err
+	}
+
+	_ = old.send(messageStop)
+	return w, nil
+}
+
+// startWorker starts a new worker process which inherits the listeners and a control socket, and waits until it is
+// ready. If it exits or is not ready before the timeout, it is killed.
+func (s *Supervisor) startWorker(index int, executable *os.File, timing *restartTiming) (*worker, error) {
+	files, listeners, err := s.listenerFiles()
+	if err != nil {
+		return nil, err
+	}
+	defer closeFiles(files)
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not create control socket: %v", err)
+	}
+	masterFile := os.NewFile(uintptr(fds[0]), "control")
+	workerFile := os.NewFile(uintptr(fds[1]), "control")
+	defer workerFile.Close()
+	control, err := net.FileConn(masterFile)
+	masterFile.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not create control socket: %v", err)
+	}
+
+	// The binary is passed after the control socket and the listeners
+	executableFD := readyFileDescriptor + 1 + len(files)
+	s.generation++
+	env, err := handoff{
+		Generation:   s.generation,
+		ParentPID:    os.Getpid(),
+		Snapshot:     s.config.SnapshotLocation,
+		Listeners:    listeners,
+		Worker:       true,
+		WorkerIndex:  index,
+		ControlFD:    readyFileDescriptor,
+		ExecutableFD: executableFD,
+		Executable:   executable.Name(),
+		Restart:      timing,
+	}.env()
+	if err != nil {
+		control.Close()
+		return nil, fmt.Errorf("could not encode handoff: %v", err)
+	}
+
+	cmd := execCommand(executable, executableFD)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(workerEnviron(), env)
+	cmd.ExtraFiles = append(append([]*os.File{workerFile}, files...), executable)
+
+	if err := cmd.Start(); err != nil {
+		control.Close()
+		return nil, fmt.Errorf("failed to launch worker: %v", err)
+	}
+
+	w := &worker{
+		index:    index,
+		cmd:      cmd,
+		started:  time.Now(),
+		control:  control,
+		messages: make(chan string, maxPendingMessages),
+		upgrades: s.upgrades,
+		done:     make(chan struct{}),
+	}
+	go w.wait()
+	go w.read()
+
+	if err := w.waitFor(messageReady, "", s.config.ReadyTimeout); err != nil {
+		_ = cmd.Process.Kill()
+		return nil, fmt.Errorf("worker %d not ready: %v", cmd.Process.Pid, err)
+	}
+	return w, nil
+}
+
+// workerEnviron returns the environment of a worker, without the systemd notification socket, since only the master
+// notifies systemd
+func workerEnviron() []string {
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "NOTIFY_SOCKET=") {
+			env = append(env, e)
+		}
+	}
+	return env
+}
+
+// cleanUp removes any Unix socket paths and the PID file when the master shuts down
+func (s *Supervisor) cleanUp() error {
+	var err error
+	for _, l := range s.listeners {
+		if e := l.removeSocket(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if s.pidFile != nil {
+		if e := s.pidFile.remove(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (w *worker) wait() {
+	w.err = w.cmd.Wait()
+	close(w.done)
+	w.control.Close()
+}
+
+// read sends the messages received from the worker to the messages channel, until the control socket is closed. It
+// never blocks, so upgrade requests are handled even when nobody is waiting for a reply: when the channel is full, the
+// oldest message is dropped, since it is a stale reply by then.
+func (w *worker) read() {
+	defer close(w.messages)
+
+	scanner := bufio.NewScanner(w.control)
+	for scanner.Scan() {
+		message := scanner.Text()
+		if strings.HasPrefix(message, messageUpgrade+" ") {
+			select {
+			case w.upgrades <- strings.TrimPrefix(message, messageUpgrade+" "):
+			default:
+				log.Print("ignoring upgrade request, an upgrade is already in progress")
+			}
+			continue
+		}
+
+		select {
+		case w.messages <- message:
+		default:
+			select {
+			case stale := <-w.messages:
+				log.Printf("dropping unread message %q from worker %d", stale, w.cmd.Process.Pid)
+			default:
+			}
+			// read is the only sender, so there is room now
+			w.messages <- message
+		}
+	}
+}
+
+func (w *worker) send(message string) error {
+	_, err := fmt.Fprintln(w.control, message)
+	return err
+}
+
+// waitFor waits until the worker sends the expected message, returning an error if it sends an error, exits or the
+// timeout expires. If id is not empty, only the replies to the request with that ID are expected, and the late
+// replies to previous requests which timed out are ignored.
+func (w *worker) waitFor(expected, id string, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case message, ok := <-w.messages:
+			if !ok {
+				return fmt.Errorf("control socket closed")
+			}
+			name, arg := splitMessage(message)
+			if id != "" {
+				var replyID string
+				if replyID, arg = splitMessage(arg); replyID != id {
+					log.Printf("ignoring stale reply %q from worker %d", message, w.cmd.Process.Pid)
+					continue
+				}
+			}
+			if name == expected {
+				return nil
+			}
+			if name == messageError {
+				return fmt.Errorf("%s", arg)
+			}
+		case <-deadline:
+			return fmt.Errorf("timed out after %s", timeout)
+		}
+	}
+}
+
+// request sends a message with a new request ID to the worker and waits for its reply
+func (w *worker) request(message, expected string, timeout time.Duration) error {
+	w.requests++
+	id := strconv.Itoa(w.requests)
+	if err := w.send(message + " " + id); err != nil {
+		return err
+	}
+	return w.waitFor(expected, id, timeout)
+}
+
+// splitMessage splits a control message in its name and its argument, if any
+func splitMessage(message string) (name, arg string) {
+	parts := strings.SplitN(message, " ", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// shutdown makes the worker drain its connections and take a snapshot, and waits until it exits. It is killed if it
+// does not exit before the timeout.
+func (w *worker) shutdown(timeout time.Duration) {
+	if err := w.send(messageShutdown); err == nil {
+		select {
+		case <-w.done:
+			return
+		case <-time.After(timeout):
+		}
+	}
+	_ = w.cmd.Process.Kill()
+	<-w.done
+}
+
+// serveControl handles the messages sent by the master to this worker, until it is told to stop or shut down. SIGINT,
+// SIGHUP and SIGUSR2 are ignored, since they are handled by the master. When there is more than one worker, the other
+// workers periodically restore the background snapshots of the primary one.
+func (s *Supervisor) serveControl() error {
+	signal.Ignore(syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR2)
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGTERM)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGUSR1)
+
+	var refresh <-chan time.Time
+	if s.config.Workers > 1 && !s.Primary() {
+		ticker := time.NewTicker(s.config.RefreshInterval)
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
+
+	messages := make(chan string)
+	go func() {
+		defer close(messages)
+
+		scanner := bufio.NewScanner(s.control)
+		for scanner.Scan() {
+			messages <- scanner.Text()
+		}
+	}()
+
+	for {
+		select {
+		case <-terminate:
+			return s.Shutdown()
+		case <-reload:
+			if err := s.ReloadCertificates(); err != nil {
+				log.Printf("could not reload certificates: %v", err)
+			}
+		case <-refresh:
+			s.refresh()
+		case message, ok := <-messages:
+			if !ok {
+				log.Print("master process is gone, shutting down")
+				return s.Shutdown()
+			}
+
+			// Requests carry an ID which is sent back with the reply
+			name, id := splitMessage(message)
+			switch name {
+			case messageSnapshot:
+				if err := s.snapshot(); err != nil {
+					s.reply(messageError + " " + id + " " + err.Error())
+				} else {
+					s.reply(messageSnapshotted + " " + id)
+				}
+			case messageResume:
+				s.resume()
+			case messageStop:
+				call(s.config.Hooks.Handoff)
+				s.drain()
+				return nil
+			case messageShutdown:
+				return s.Shutdown()
+			}
+		}
+	}
+}
+
+func (s *Supervisor) reply(message string) {
+	if _, err := fmt.Fprintln(s.control, message); err != nil {
+		log.Printf("could not reply to master process: %v", err)
+	}
+}
+
+// refresh restores the latest refresh snapshot saved by the primary worker
+func (s *Supervisor) refresh() {
+	if s.config.Restore == nil {
+		return
+	}
+	if err := s.config.Restore(s.config.RefreshLocation); err != nil {
+		log.Printf("could not refresh snapshot: %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+package graceful
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// controlPipe returns the master and worker ends of a control socket, closed when the test finishes
+func controlPipe(t *testing.T) (net.Conn, net.Conn) {
+	master, worker := net.Pipe()
+	t.Cleanup(func() {
+		master.Close()
+		worker.Close()
+	})
+	return master, worker
+}
+
+// readMessage reads a control message, failing the test if none is received in time
+func readMessage(t *testing.T, conn net.Conn, r *bufio.Reader) string {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("could not read control message: %v", err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+func TestWorkerMessages(t *testing.T) {
+	master, control := controlPipe(t)
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgrades := make(chan string, 1)
+	w := &worker{
+		cmd:      &exec.Cmd{Process: process},
+		control:  master,
+		messages: make(chan string, maxPendingMessages),
+		upgrades: upgrades,
+	}
+	go w.read()
+
+	// Replies nobody waits for anymore do not block the upgrade requests sent after them
+	for i := 0; i < 2*maxPendingMessages; i++ {
+		if _, err := fmt.Fprintf(control, "%s 0\n", messageSnapshotted); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fmt.Fprintf(control, "%s /usr/local/bin/app\n", messageUpgrade); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case path := <-upgrades:
+		if path != "/usr/local/bin/app" {
+			t.Errorf("got upgrade to %q", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upgrade request was not received after unread replies")
+	}
+
+	tests := []struct {
+		name  string
+		reply string
+		err   string
+	}{
+		{"snapshotted", messageSnapshotted + " 1", ""},
+		{"error", messageError + " 2 disk full", "disk full"},
+	}
+	r := bufio.NewReader(control)
+	for _, test := range tests {
+		replied := make(chan error, 1)
+		go func() {
+			request := readMessage(t, control, r)
+			_, id := splitMessage(request)
+			// The stale reply to an earlier request is ignored
+			_, err := fmt.Fprintf(control, "%s 0\n%s\n", messageSnapshotted, test.reply)
+			if err == nil && request != messageSnapshot+" "+id {
+				err = fmt.Errorf("got request %q", request)
+			}
+			replied <- err
+		}()
+
+		err := w.request(messageSnapshot, messageSnapshotted, 5*time.Second)
+		if err := <-replied; err != nil {
+			t.Fatal(err)
+		}
+		if test.err == "" && err != nil || test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%s: got %v, want error %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestServeControl(t *testing.T) {
+	t.Cleanup(func() {
+		signal.Reset(syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTERM)
+	})
+	master, control := controlPipe(t)
+
+	var snapshotErr error
+	resumed := make(chan struct{}, 1)
+	handedOff := make(chan struct{}, 1)
+	s := New(Config{
+		Snapshot: func(string) error {
+			return snapshotErr
+		},
+		Hooks: Hooks{
+			Resume:  func() { resumed <- struct{}{} },
+			Handoff: func() { handedOff <- struct{}{} },
+		},
+	})
+	s.handoff = &handoff{Worker: true}
+	s.control = control
+	served := make(chan error, 1)
+	go func() {
+		served <- s.serveControl()
+	}()
+
+	r := bufio.NewReader(master)
+	send := func(message string) {
+		if _, err := fmt.Fprintln(master, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(messageSnapshot + " 1")
+	if reply := readMessage(t, master, r); reply != messageSnapshotted+" 1" {
+		t.Errorf("got reply %q to a snapshot request", reply)
+	}
+	send(messageResume)
+	<-resumed
+
+	snapshotErr = errors.New("disk full")
+	send(messageSnapshot + " 2")
+	if reply := readMessage(t, master, r); reply != messageError+" 2 could not take snapshot: disk full" {
+		t.Errorf("got reply %q to a failed snapshot request", reply)
+	}
+	send(messageResume)
+	<-resumed
+
+	send(messageStop)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("got %v stopping", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the worker did not stop")
+	}
+	select {
+	case <-handedOff:
+	default:
+		t.Error("the worker stopped without calling the Handoff hook")
+	}
+}
+
+// workerHelperEnv makes the test binary run TestWorkerHelper as a worker process, with its snapshots at the location
+// it is set to
+const workerHelperEnv = "GRACEFUL_TEST_WORKER_HELPER"
+
+func TestReplaceWorker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	location := filepath.Join(dir, "snapshot")
+
+	// The workers run with the arguments of this process
+	t.Setenv(workerHelperEnv, location)
+	args := os.Args
+	os.Args = []string{args[0], "-test.run=^TestWorkerHelper$"}
+	t.Cleanup(func() { os.Args = args })
+
+	s := New(Config{
+		Listeners:        []Listener{{Name: "http", Addr: "127.0.0.1:0"}},
+		SnapshotLocation: location,
+		Master:           true,
+	})
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.listeners[0].Close() })
+	executable, err := s.executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := s.startWorker(0, executable, nil)
+	executable.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replacement, err := s.replaceWorker(old)
+	if err != nil {
+		old.shutdown(5 * time.Second)
+		t.Fatal(err)
+	}
+	select {
+	case <-old.done:
+		if old.err != nil {
+			t.Errorf("replaced worker exited with %v", old.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("replaced worker did not stop")
+	}
+	replacement.shutdown(5 * time.Second)
+	if replacement.err != nil {
+		t.Errorf("worker exited with %v on shutdown", replacement.err)
+	}
+
+	// The replaced worker took a snapshot for its replacement, and the replacement one on shutdown
+	b, err := ioutil.ReadFile(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("%d\n%d\n", old.cmd.Process.Pid, replacement.cmd.Process.Pid)
+	if string(b) != want {
+		t.Errorf("snapshots were taken by %q, want %q", b, want)
+	}
+}
+
+// TestWorkerHelper is a worker process started by TestReplaceWorker, which serves the control messages of the master
+// and appends its PID to the snapshot on every snapshot
+func TestWorkerHelper(t *testing.T) {
+	location := os.Getenv(workerHelperEnv)
+	if location == "" || os.Getenv(handoffEnv) == "" {
+		t.Skip("only run by TestReplaceWorker")
+	}
+
+	s := New(Config{
+		Listeners:        []Listener{{Name: "http", Addr: "127.0.0.1:0"}},
+		SnapshotLocation: location,
+		Snapshot: func(location string) error {
+			f, err := os.OpenFile(location, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(f, os.Getpid())
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			return err
+		},
+		Master: true,
+	})
+	if !s.isWorker() {
+		t.Fatal("not started as a worker")
+	}
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,106 @@
+package graceful
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const pidLockSuffix = ".lock"
+
+// pidFile is a PID file guarded by an exclusive lock on a separate lock file, since the PID file itself is replaced
+// on every write. The lock is inherited by child processes, so it is held until the last process shuts down.
+type pidFile struct {
+	path string
+	lock *os.File
+}
+
+// lockPIDFile acquires the lock of the PID file at the given path, or takes over the lock inherited from the parent
+// process if any
+func lockPIDFile(path string, inherited *os.File) (*pidFile, error) {
+	lock := inherited
+	if lock == nil {
+		var err error
+		lock, err = os.OpenFile(path+pidLockSuffix, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("could not open PID lock file: %v", err)
+		}
+	}
+
+	err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		lock.Close()
+		return nil, fmt.Errorf("PID file %s is locked by another instance with PID %s", path, readPID(path))
+	}
+	if err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("could not lock PID file %s: %v", path, err)
+	}
+
+	return &pidFile{path: path, lock: lock}, nil
+}
+
+// write atomically writes the current PID to the file
+func (p *pidFile) write() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(p.path), filepath.Base(p.path)+".")
+	if err != nil {
+		return fmt.Errorf("could not write PID file: %v", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	_, err = fmt.Fprintf(tmp, "%d\n", os.Getpid())
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p.path)
+	}
+	if err != nil {
+		return fmt.Errorf("could not write PID file: %v", err)
+	}
+	return nil
+}
+
+// remove removes the PID file. The lock file is kept, so another instance waiting for it can not lock a removed file.
+func (p *pidFile) remove() error {
+	err := os.Remove(p.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove PID file: %v", err)
+	}
+	return nil
+}
+
+// lockPIDFile locks the configured PID file, and writes it unless the process was started by a restart, in which
+// case it is written once the process is ready
+func (s *Supervisor) lockPIDFile() error {
+	var inherited *os.File
+	if s.handoff != nil && s.handoff.PIDLockFD != 0 {
+		syscall.CloseOnExec(s.handoff.PIDLockFD)
+		inherited = os.NewFile(uintptr(s.handoff.PIDLockFD), s.config.PIDFile+pidLockSuffix)
+	}
+
+	p, err := lockPIDFile(s.config.PIDFile, inherited)
+	if err != nil {
+		return err
+	}
+	s.pidFile = p
+
+	if s.handoff == nil {
+		return p.write()
+	}
+	return nil
+}
+
+func readPID(path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,526 @@
+// Package graceful provides the machinery to restart a process with zero
+// downtime: the listening socket is handed over to a new child process, and
+// the application state is saved in a snapshot that the child restores.
+package graceful
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	readyFileDescriptor = 3
+
+	defaultReadyTimeout    = 30 * time.Second
+	defaultDrainTimeout    = 30 * time.Second
+	defaultWorkers         = 1
+	defaultRefreshInterval = time.Second
+	refreshSuffix          = ".refresh"
+)
+
+// Hooks are functions called by the Supervisor at different points of the process lifecycle
+type Hooks struct {
+	// BeforeSnapshot is called before taking a snapshot, and should stop handling new work
+	BeforeSnapshot func()
+	// AfterRestore is called after restoring a snapshot, and should start handling work
+	AfterRestore func()
+	// BeforeFork is called right before starting the new process on a restart
+	BeforeFork func()
+	// Resume is called when a restart fails and this process keeps serving, and should start handling work again
+	Resume func()
+	// Handoff is called once the new process is ready, before draining the connections of this one, and should
+	// reject the work held since BeforeSnapshot, which this process will never handle
+	Handoff func()
+	// AfterDrain is called when the connections have been drained, before the process stops
+	AfterDrain func(report DrainReport)
+}
+
+// Config is the configuration of a Supervisor
+type Config struct {
+	// Listeners are the listeners to serve requests on
+	Listeners []Listener
+	// SnapshotLocation is where snapshots are saved, usually an absolute path. It is passed to the new process on a
+	// restart, which restores the snapshot from there even if its own location is different.
+	SnapshotLocation string
+	// LineageFile is the path of the file where the lineage is saved alongside the snapshots, the SnapshotLocation
+	// followed by .lineage by default. It must be set if the SnapshotLocation is not a file path.
+	LineageFile string
+	// Snapshot saves the application state in the given location, to be restored by the next process. Background
+	// snapshots are taken while work is being handled, so it must be safe to call concurrently with it.
+	Snapshot func(location string) error
+	// Restore restores the application state saved by the previous process in the given location
+	Restore func(location string) error
+	// Check validates the snapshot in the given location, returning an error if this binary can not restore it. It is
+	// run by the new binary in a separate process before every restart, which is refused if it fails. Restore is used
+	// if nil.
+	Check func(location string) error
+	// ReadyTimeout is how long to wait for the new process to be ready on a restart, 30 seconds by default
+	ReadyTimeout time.Duration
+	// PIDFile is the path of the PID file, which is locked so only one instance can use it, and updated by every new
+	// process once it is ready. It is not used if empty.
+	PIDFile string
+	// DrainTimeout is how long to wait for active requests to finish before closing their connections when stopping,
+	// 30 seconds by default
+	DrainTimeout time.Duration
+	// Master enables the master/worker mode, where this process only owns the listeners and runs the application in
+	// worker processes, which it replaces on SIGHUP and restarts when they exit
+	Master bool
+	// Workers is the number of worker processes in master/worker mode, 1 by default. They all accept connections on
+	// the same inherited sockets, but only the first one is primary and owns the application state.
+	Workers int
+	// SnapshotInterval is how often a background snapshot is taken while serving, so an unexpected exit loses at most
+	// the work done since then. Background snapshots are not taken periodically if 0.
+	SnapshotInterval time.Duration
+	// RefreshInterval is how often the primary worker saves a snapshot and the other workers restore it when there is
+	// more than one worker, 1 second by default
+	RefreshInterval time.Duration
+	// RefreshLocation is where the primary worker saves the snapshots restored by the other workers every
+	// RefreshInterval, so they do not replace the ones at the SnapshotLocation. It is the SnapshotLocation followed by
+	// .refresh by default, and it must be set if the SnapshotLocation is not a file path.
+	RefreshLocation string
+	// Watch are files, usually the executable and its configuration, which trigger a restart as if on SIGHUP when they
+	// change. It is meant for development, to restart on every build.
+	Watch []string
+	// WatchDebounce is how long to wait after a watched file changes without more changes before restarting, 500
+	// milliseconds by default
+	WatchDebounce time.Duration
+	// Executable is the binary to start on a restart, such as a symlink to the current release updated by the deploy
+	// tool, relative to the initial working directory. By default it is the executable of the current process,
+	// resolved through /proc/self/exe.
+	Executable string
+	// ArchiveDir is the directory where the binary of every process which starts successfully is archived, named after
+	// its generation, so it can be rolled back to. Binaries are not archived if empty.
+	ArchiveDir string
+	// MaxArchived is how many binaries are kept in the archive directory, 5 by default
+	MaxArchived int
+	// Verification is how the binary is verified before starting it on a restart, or nil to start it unverified
+	Verification *Verification
+	// Hooks are the lifecycle hooks
+	Hooks Hooks
+}
+
+// Supervisor manages the lifecycle of a process which can be restarted gracefully
+type Supervisor struct {
+	config     Config
+	listeners  []*gracefulListener
+	handoff    *handoff
+	generation int
+	pidFile    *pidFile
+	control    net.Conn
+
+	// removedSockets are the Unix socket paths of the inherited sockets which are not used anymore, to be removed once
+	// this process is ready
+	removedSockets []string
+
+	// snapshotMu serializes snapshots, and paused is whether the work is stopped for a restart after a snapshot
+	snapshotMu sync.Mutex
+	paused     bool
+
+	// binary is the binary requested with Upgrade, and upgrades receives the upgrade requests
+	binary   string
+	upgrades chan string
+
+	// checkpoints receives the background snapshots requested with Checkpoint
+	checkpoints chan struct{}
+
+	// restoreDuration is how long restoring the snapshot took on startup
+	restoreDuration time.Duration
+
+	mu      sync.RWMutex
+	lineage Lineage
+}
+
+// New creates a new Supervisor with the given configuration
+func New(config Config) *Supervisor {
+	listeners := make([]Listener, len(config.Listeners))
+	for i, l := range config.Listeners {
+		if l.Network == "" {
+			l.Network = "tcp"
+		}
+		if l.Server == nil {
+			l.Server = &http.Server{}
+		}
+		listeners[i] = l
+	}
+	config.Listeners = listeners
+	if config.ReadyTimeout == 0 {
+		config.ReadyTimeout = defaultReadyTimeout
+	}
+	if config.DrainTimeout == 0 {
+		config.DrainTimeout = defaultDrainTimeout
+	}
+	if config.Workers == 0 {
+		config.Workers = defaultWorkers
+	}
+	if config.RefreshInterval == 0 {
+		config.RefreshInterval = defaultRefreshInterval
+	}
+	if config.RefreshLocation == "" && config.SnapshotLocation != "" {
+		config.RefreshLocation = config.SnapshotLocation + refreshSuffix
+	}
+	if config.WatchDebounce == 0 {
+		config.WatchDebounce = defaultWatchDebounce
+	}
+	if config.MaxArchived == 0 {
+		config.MaxArchived = defaultMaxArchived
+	}
+	for _, path := range []*string{&config.Executable, &config.ArchiveDir, &config.LineageFile} {
+		if *path == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(*path); err == nil {
+			*path = abs
+		}
+	}
+
+	s := &Supervisor{
+		config:      config,
+		handoff:     readHandoff(),
+		generation:  1,
+		upgrades:    make(chan string, 1),
+		checkpoints: make(chan struct{}, 1),
+	}
+	if s.handoff != nil {
+		s.generation = s.handoff.Generation
+		if s.handoff.ExecutableFD != 0 {
+			// The binary was only inherited to be executed
+			_ = syscall.Close(s.handoff.ExecutableFD)
+		}
+	}
+	s.lineage = Lineage{Process: s.currentProcess()}
+	return s
+}
+
+// Listen locks the PID file and starts listening on all the configured listeners, inheriting the sockets from the
+// parent process when restarting gracefully, or from systemd when using socket activation. When the process was
+// started in check mode by a restart, it validates the snapshot and exits instead.
+func (s *Supervisor) Listen() error {
+	if s.handoff != nil && s.handoff.Check {
+		s.runCheck()
+	}
+
+	if s.config.PIDFile != "" && !s.isWorker() {
+		if err := s.lockPIDFile(); err != nil {
+			return err
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, l := range s.config.Listeners {
+		if l.Name == "" {
+			return fmt.Errorf("listener for %s address %s has no name", l.Network, l.Addr)
+		}
+		if names[l.Name] {
+			return fmt.Errorf("listener name already configured: %s", l.Name)
+		}
+		names[l.Name] = true
+	}
+
+	return s.listen()
+}
+
+// Serve serves HTTP requests on all the listeners until their servers are closed. Listeners which are only for the
+// primary process are not served by the other workers.
+func (s *Supervisor) Serve() error {
+	if len(s.listeners) == 0 {
+		return fmt.Errorf("not listening")
+	}
+
+	errs := make(chan error, len(s.listeners))
+	var serving int
+	for i, l := range s.listeners {
+		if s.config.Listeners[i].PrimaryOnly && !s.Primary() {
+			continue
+		}
+		serving++
+		go func(server *http.Server, l *gracefulListener) {
+			if l.certificate != nil {
+				errs <- server.ServeTLS(l, "", "")
+			} else {
+				errs <- server.Serve(l)
+			}
+		}(s.config.Listeners[i].Server, l)
+	}
+
+	var err error
+	for ; serving > 0; serving-- {
+		if e := <-errs; e != http.ErrServerClosed && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Restore restores the application state and the lineage saved alongside it, and calls the AfterRestore hook
+func (s *Supervisor) Restore() error {
+	location := s.config.SnapshotLocation
+	if s.handoff != nil {
+		location = s.handoff.Snapshot
+	}
+
+	if s.config.Restore != nil {
+		start := time.Now()
+		if err := s.config.Restore(location); err != nil {
+			return fmt.Errorf("could not restore snapshot: %v", err)
+		}
+		s.restoreDuration = time.Since(start)
+	}
+	if location != "" {
+		if err := s.restoreLineage(location); err != nil {
+			log.Print(err)
+		}
+	}
+
+	call(s.config.Hooks.AfterRestore)
+	return nil
+}
+
+// Ready notifies the parent process that this process is ready to take over, or systemd that it is ready to serve,
+// archives its binary and starts taking background snapshots
+func (s *Supervisor) Ready() error {
+	if s.Primary() {
+		go s.runCheckpoints()
+	}
+	if s.config.ArchiveDir != "" && s.Primary() {
+		if err := s.archive(); err != nil {
+			log.Print(err)
+		}
+	}
+
+	if s.handoff == nil {
+		return notify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+	}
+	if s.handoff.Restart != nil {
+		s.reportRestart(s.handoff.Restart)
+	}
+
+	if s.isWorker() {
+		f := os.NewFile(uintptr(s.handoff.ControlFD), "control")
+		control, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("could not connect to master process: %v", err)
+		}
+		s.control = control
+		s.reply(messageReady)
+		return nil
+	}
+
+	f := os.NewFile(uintptr(s.handoff.ReadyFD), "ready")
+	defer f.Close()
+
+	_, err := f.Write([]byte{readyMessage})
+	if err != nil {
+		return fmt.Errorf("could not notify readiness to parent process: %v", err)
+	}
+	s.removeSockets()
+
+	// The parent process is already handing off to this one, so failing now would leave nothing serving
+	if s.pidFile != nil {
+		if err := s.pidFile.write(); err != nil {
+			log.Print(err)
+		}
+	}
+	return nil
+}
+
+// Wait blocks until the process receives a signal, and then shuts down on SIGINT or SIGTERM, or restarts on SIGHUP,
+// when a watched file changes or when an upgrade is requested. SIGUSR2 rolls back to the previous archived binary. If
+// a restart fails this process keeps serving and waiting for signals. TLS certificates are reloaded on SIGUSR1.
+// Workers wait for messages from their master process instead.
+func (s *Supervisor) Wait() error {
+	if s.control != nil {
+		return s.serveControl()
+	}
+
+	changes, err := s.watch()
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	restart := make(chan os.Signal, 1)
+	signal.Notify(restart, syscall.SIGHUP)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGUSR1)
+	rollback := make(chan os.Signal, 1)
+	signal.Notify(rollback, syscall.SIGUSR2)
+
+	for {
+		select {
+		case <-stop:
+			return s.Shutdown()
+		case <-reload:
+			if err := s.ReloadCertificates(); err != nil {
+				log.Printf("could not reload certificates: %v", err)
+			}
+		case <-restart:
+			err := s.Restart()
+			if err == nil {
+				return nil
+			}
+			log.Printf("restart failed, still serving: %v", err)
+		case <-changes:
+			log.Print("watched files changed, restarting")
+			err := s.Restart()
+			if err == nil {
+				return nil
+			}
+			log.Printf("restart failed, still serving: %v", err)
+		case <-rollback:
+			if err := s.Rollback(); err != nil {
+				log.Printf("could not roll back: %v", err)
+			}
+		case path := <-s.upgrades:
+			log.Printf("upgrading to %s", path)
+			s.binary = path
+			err := s.Restart()
+			if err == nil {
+				return nil
+			}
+			s.binary = ""
+			log.Printf("upgrade failed, still serving: %v", err)
+		}
+	}
+}
+
+// ReloadCertificates reloads the TLS certificates of all the listeners from their files, without restarting.
+// Listeners whose certificate can not be loaded keep serving the current one.
+func (s *Supervisor) ReloadCertificates() error {
+	var err error
+	for _, l := range s.listeners {
+		if l.certificate == nil {
+			continue
+		}
+		if e := l.certificate.reload(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Restart takes a snapshot, checks that the new binary can restore it, and starts a new process which inherits the
+// listening socket, and then drains the connections of this process. If the new process is not ready in time, it is
+// killed and the Resume hook is called.
+func (s *Supervisor) Restart() error {
+	logNotify("RELOADING=1")
+
+	timing := &restartTiming{Start: time.Now()}
+	if err := s.snapshot(); err != nil {
+		s.resume()
+		return err
+	}
+	timing.Snapshot = time.Since(timing.Start)
+
+	executable, err := s.executable()
+	if err != nil {
+		s.resume()
+		return err
+	}
+	defer executable.Close()
+	if err := s.check(executable); err != nil {
+		s.resume()
+		return err
+	}
+
+	call(s.config.Hooks.BeforeFork)
+	pid, err := s.startFork(executable, timing)
+	if err != nil {
+		s.resume()
+		return err
+	}
+
+	logNotify(fmt.Sprintf("MAINPID=%d\nREADY=1", pid))
+	call(s.config.Hooks.Handoff)
+	s.drain()
+	return nil
+}
+
+// reportRestart logs the latency of the restart which started this process and records it in the lineage
+func (s *Supervisor) reportRestart(timing *restartTiming) {
+	latency := &RestartLatency{
+		Total:    time.Since(timing.Start),
+		Snapshot: timing.Snapshot,
+		Restore:  s.restoreDuration,
+	}
+	log.Printf("restarted in %s: snapshot took %s, restore took %s", latency.Total, latency.Snapshot, latency.Restore)
+
+	s.mu.Lock()
+	s.lineage.Restart = latency
+	s.mu.Unlock()
+}
+
+func (s *Supervisor) resume() {
+	s.snapshotMu.Lock()
+	s.paused = false
+	s.snapshotMu.Unlock()
+
+	call(s.config.Hooks.Resume)
+	logNotify("READY=1")
+}
+
+// Shutdown drains the connections, takes a snapshot and removes any Unix socket paths and the PID file
+func (s *Supervisor) Shutdown() error {
+	logNotify("STOPPING=1")
+
+	s.drain()
+	err := s.snapshot()
+
+	for _, l := range s.listeners {
+		if e := l.removeSocket(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if s.pidFile != nil {
+		if e := s.pidFile.remove(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// snapshot stops the work and takes a snapshot for the next process, until resume is called. Only the primary
+// process takes snapshots.
+func (s *Supervisor) snapshot() error {
+	if !s.Primary() {
+		return nil
+	}
+
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+
+	s.paused = true
+	call(s.config.Hooks.BeforeSnapshot)
+	return s.saveSnapshot(s.config.SnapshotLocation)
+}
+
+// saveSnapshot saves a snapshot in the given location, and the lineage alongside it unless it is a refresh snapshot,
+// which is only restored by the other workers
+func (s *Supervisor) saveSnapshot(location string) error {
+	if s.config.Snapshot != nil {
+		if err := s.config.Snapshot(location); err != nil {
+			return fmt.Errorf("could not take snapshot: %v", err)
+		}
+	}
+	if location != "" && location == s.config.SnapshotLocation {
+		if err := s.saveLineage(location); err != nil {
+			log.Print(err)
+		}
+	}
+	return nil
+}
+
+func call(hook func()) {
+	if hook != nil {
+		hook()
+	}
+}
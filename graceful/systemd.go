@@ -0,0 +1,74 @@
+package graceful
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+// systemdFiles returns the sockets passed by systemd socket activation, named after LISTEN_FDNAMES.
+// The LISTEN_* variables are unset so they are not inherited by child processes.
+func systemdFiles() []*os.File {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	files := make([]*os.File, n)
+	for i := range files {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files[i] = os.NewFile(uintptr(fd), name)
+	}
+	return files
+}
+
+// notify sends a state notification to systemd, if the process was started with NOTIFY_SOCKET
+func notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("could not connect to notify socket %s: %v", path, err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return fmt.Errorf("could not send notification to systemd: %v", err)
+	}
+	return nil
+}
+
+// logNotify sends a state notification to systemd, logging any error
+func logNotify(state string) {
+	if err := notify(state); err != nil {
+		log.Print(err)
+	}
+}
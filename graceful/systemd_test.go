@@ -0,0 +1,270 @@
+package graceful
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenNotifySocket listens on a Unix datagram socket in a temporary directory and points NOTIFY_SOCKET to it
+func listenNotifySocket(t *testing.T) *net.UnixConn {
+	dir, err := ioutil.TempDir("", "graceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// readNotifications reads the given number of notifications sent to conn
+func readNotifications(t *testing.T, conn *net.UnixConn, n int) []string {
+	var states []string
+	buf := make([]byte, 4096)
+	for i := 0; i < n; i++ {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		size, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("could not read notification %d: %v", i, err)
+		}
+		states = append(states, string(buf[:size]))
+	}
+	return states
+}
+
+func TestNotify(t *testing.T) {
+	conn := listenNotifySocket(t)
+
+	s := New(Config{
+		Snapshot: func(string) error {
+			return errors.New("no snapshot")
+		},
+	})
+	if err := s.Restart(); err == nil {
+		t.Fatal("restart succeeded without a snapshot")
+	}
+	if err := s.Shutdown(); err == nil {
+		t.Fatal("shutdown succeeded without a snapshot")
+	}
+	mainPID := fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid())
+	if err := notify(mainPID); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readNotifications(t, conn, 4)
+	want := []string{"RELOADING=1", "READY=1", "STOPPING=1", mainPID}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("notification %d is %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+
+	if err := notify("READY=1"); err != nil {
+		t.Errorf("notify without NOTIFY_SOCKET failed: %v", err)
+	}
+}
+
+// systemdHelperEnv makes the test binary run TestSystemdFilesHelper as a process started by socket activation
+const systemdHelperEnv = "GRACEFUL_TEST_SYSTEMD_HELPER"
+
+func TestSystemdFiles(t *testing.T) {
+	var files []*os.File
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	tests := []struct {
+		name     string
+		pid      string
+		fds      string
+		fdNames  string
+		expected []string
+	}{
+		{"named", "self", "2", "http:admin", []string{"http " + addrs[0], "admin " + addrs[1]}},
+		{"unnamed", "self", "2", "", []string{"LISTEN_FD_3 " + addrs[0], "LISTEN_FD_4 " + addrs[1]}},
+		{"partially named", "self", "2", "http", []string{"http " + addrs[0], "LISTEN_FD_4 " + addrs[1]}},
+		{"fewer fds", "self", "1", "http:admin", []string{"http " + addrs[0]}},
+		{"other process", "1", "2", "http:admin", nil},
+		{"no fds", "self", "0", "", nil},
+		{"invalid fds", "self", "two", "", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdFilesHelper$")
+			cmd.Env = append(os.Environ(),
+				systemdHelperEnv+"="+test.pid,
+				"LISTEN_FDS="+test.fds,
+				"LISTEN_FDNAMES="+test.fdNames,
+			)
+			cmd.ExtraFiles = files
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("helper failed: %v\n%s", err, out)
+			}
+
+			var got []string
+			for _, line := range strings.Split(string(out), "\n") {
+				if strings.HasPrefix(line, "file ") {
+					got = append(got, strings.TrimPrefix(line, "file "))
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(test.expected, ",") {
+				t.Errorf("got files %q, want %q", got, test.expected)
+			}
+			if !strings.Contains(string(out), "unset LISTEN_PID LISTEN_FDS LISTEN_FDNAMES") {
+				t.Errorf("LISTEN_* variables were not unset:\n%s", out)
+			}
+		})
+	}
+}
+
+// TestSystemdFilesHelper prints the files returned by systemdFiles when run by TestSystemdFiles, with the listeners
+// passed as extra files and LISTEN_PID set to its own PID or the one given in systemdHelperEnv
+func TestSystemdFilesHelper(t *testing.T) {
+	pid := os.Getenv(systemdHelperEnv)
+	if pid == "" {
+		t.Skip("only run by TestSystemdFiles")
+	}
+	if pid == "self" {
+		pid = strconv.Itoa(os.Getpid())
+	}
+	t.Setenv("LISTEN_PID", pid)
+
+	for _, f := range systemdFiles() {
+		l, err := net.FileListener(f)
+		if err != nil {
+			t.Fatalf("file %s is not a listener: %v", f.Name(), err)
+		}
+		fmt.Printf("file %s %s\n", f.Name(), l.Addr())
+		l.Close()
+	}
+
+	var set []string
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(name); ok {
+			set = append(set, name)
+		}
+	}
+	if len(set) == 0 {
+		fmt.Println("unset LISTEN_PID LISTEN_FDS LISTEN_FDNAMES")
+	}
+}
+
+// handoffHelperEnv makes the test binary run TestReadyHandoffHelper as the process started by a restart, with the PID
+// file at the path it is set to
+const handoffHelperEnv = "GRACEFUL_TEST_HANDOFF_HELPER"
+
+func TestReadyHandoff(t *testing.T) {
+	conn := listenNotifySocket(t)
+	dir, err := ioutil.TempDir("", "graceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	pidPath := filepath.Join(dir, "app.pid")
+
+	// The new process runs with the arguments of this one
+	t.Setenv(handoffHelperEnv, pidPath)
+	args := os.Args
+	os.Args = []string{args[0], "-test.run=^TestReadyHandoffHelper$"}
+	t.Cleanup(func() { os.Args = args })
+
+	s := New(Config{PIDFile: pidPath, Listeners: []Listener{{Name: "http", Addr: "127.0.0.1:0"}}})
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.listeners[0].Close() })
+	if err := s.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	if pid := readPID(pidPath); pid != strconv.Itoa(os.Getpid()) {
+		t.Errorf("PID file has PID %s before the restart, want %d", pid, os.Getpid())
+	}
+
+	if err := s.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	got := readNotifications(t, conn, 3)
+	want := []string{fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()), "RELOADING=1"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("notification %d is %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	// The new process accepts a connection on the inherited listener and replies with its PID once it is ready
+	c, err := net.Dial("tcp", s.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	childPID, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[2] != fmt.Sprintf("MAINPID=%s\nREADY=1", childPID) {
+		t.Errorf("notification after the restart is %q, want the PID of the new process %s", got[2], childPID)
+	}
+	if pid := readPID(pidPath); pid != string(childPID) {
+		t.Errorf("PID file has PID %s after the restart, want the PID of the new process %s", pid, childPID)
+	}
+}
+
+// TestReadyHandoffHelper is the process started by the restart in TestReadyHandoff. Once it is ready it replies to
+// a connection on the inherited listener with its PID.
+func TestReadyHandoffHelper(t *testing.T) {
+	pidPath := os.Getenv(handoffHelperEnv)
+	if pidPath == "" || os.Getenv(handoffEnv) == "" {
+		t.Skip("only run by TestReadyHandoff")
+	}
+
+	s := New(Config{PIDFile: pidPath, Listeners: []Listener{{Name: "http", Addr: "127.0.0.1:0"}}})
+	if s.handoff == nil {
+		t.Fatal("not started by a restart")
+	}
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ready(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := s.listeners[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "%d", os.Getpid())
+}
@@ -0,0 +1,131 @@
+package graceful
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLS is the TLS configuration of a listener. Certificates are loaded from files when listening, so a new process
+// always picks up the current ones, and can be reloaded without restarting on SIGUSR1 or when the files change.
+type TLS struct {
+	// CertFile is the path to the PEM encoded certificate chain
+	CertFile string
+	// KeyFile is the path to the PEM encoded private key
+	KeyFile string
+	// WatchInterval is how often to check the files for changes, or 0 to only reload them on SIGUSR1
+	WatchInterval time.Duration
+}
+
+// certificate is a TLS certificate loaded from files, which can be reloaded while serving
+type certificate struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertificate(config TLS) (*certificate, error) {
+	c := &certificate{
+		certFile: config.CertFile,
+		keyFile:  config.KeyFile,
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	if config.WatchInterval > 0 {
+		go c.watch(config.WatchInterval)
+	}
+	return c, nil
+}
+
+// reload loads the certificate and key from their files. Expired certificates are refused, and the current one is
+// kept if loading fails.
+func (c *certificate) reload() error {
+	modTime, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load certificate %s: %v", c.certFile, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("could not parse certificate %s: %v", c.certFile, err)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return fmt.Errorf("certificate %s expired at %s", c.certFile, leaf.NotAfter)
+	}
+	cert.Leaf = leaf
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.mu.Unlock()
+	return nil
+}
+
+// lastModified returns the latest modification time of the certificate and key files
+func (c *certificate) lastModified() (time.Time, error) {
+	var modTime time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("could not read certificate file: %v", err)
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+// watch reloads the certificate whenever its files change
+func (c *certificate) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		modTime, err := c.lastModified()
+		if err != nil {
+			continue
+		}
+
+		c.mu.RLock()
+		changed := !modTime.Equal(c.modTime)
+		c.mu.RUnlock()
+
+		if changed {
+			if err := c.reload(); err != nil {
+				log.Printf("could not reload certificate, keeping the current one: %v", err)
+				continue
+			}
+			log.Printf("reloaded certificate %s", c.certFile)
+		}
+	}
+}
+
+func (c *certificate) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.cert, nil
+}
+
+// tlsConfig returns the TLS configuration of a server using this certificate, based on the server's own configuration
+func (c *certificate) tlsConfig(base *tls.Config) *tls.Config {
+	var config *tls.Config
+	if base != nil {
+		config = base.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	config.Certificates = nil
+	config.GetCertificate = c.getCertificate
+	return config
+}
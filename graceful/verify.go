@@ -0,0 +1,126 @@
+package graceful
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// SignatureSuffix is appended to the path of a binary to find its detached signature
+const SignatureSuffix = ".sig"
+
+// Verification is how a binary is verified before being started with the listening sockets. A binary is accepted if
+// it has a valid signature or one of the pinned checksums, and any binary is accepted if neither is configured.
+type Verification struct {
+	// PublicKey is the ed25519 key of the detached signatures, which are read from the path of the binary, after
+	// resolving symlinks, followed by SignatureSuffix, either raw or base64 encoded
+	PublicKey ed25519.PublicKey
+	// SHA256 are the hex encoded SHA-256 checksums of the accepted binaries
+	SHA256 []string
+}
+
+// enabled returns whether binaries are verified at all
+func (v *Verification) enabled() bool {
+	return v != nil && (len(v.PublicKey) > 0 || len(v.SHA256) > 0)
+}
+
+// verify opens the binary at the given path, after resolving any symlinks, and verifies it. The binary must then be
+// started from the returned file with execCommand, so the verified binary is the one started even if its path or a
+// symlink changes in between. When a Verification is configured, the returned file is a private copy of the verified
+// contents, so modifying the original file has no effect either. It returns an error if the binary can not be
+// verified.
+func (s *Supervisor) verify(path string) (*os.File, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve binary %s: %v", path, err)
+	}
+	if !s.config.Verification.enabled() {
+		f, err := os.Open(resolved)
+		if err != nil {
+			return nil, fmt.Errorf("could not read binary %s: %v", resolved, err)
+		}
+		return f, nil
+	}
+
+	binary, err := ioutil.ReadFile(resolved)
+	if err != nil {
+		return nil, fmt.Errorf("could not read binary %s: %v", resolved, err)
+	}
+	if err := s.verifyBinary(resolved, binary); err != nil {
+		return nil, err
+	}
+	return privateCopy(resolved, binary)
+}
+
+// verifyBinary returns an error if the contents of the binary with the given path can not be verified
+func (s *Supervisor) verifyBinary(path string, binary []byte) error {
+	v := s.config.Verification
+	if !v.enabled() {
+		return nil
+	}
+
+	sum := sha256.Sum256(binary)
+	checksum := hex.EncodeToString(sum[:])
+	for _, pinned := range v.SHA256 {
+		if strings.EqualFold(strings.TrimSpace(pinned), checksum) {
+			return nil
+		}
+	}
+
+	if len(v.PublicKey) == 0 {
+		return fmt.Errorf("binary %s with SHA-256 %s is not pinned", path, checksum)
+	}
+	signature, err := readSignature(path + SignatureSuffix)
+	if err != nil {
+		return err
+	}
+	if len(v.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(v.PublicKey, binary, signature) {
+		return fmt.Errorf("invalid signature for binary %s", path)
+	}
+	return nil
+}
+
+// privateCopy writes a verified binary to a file in a new temporary directory only this user can access, and opens it
+// read-only so it can be executed. The copy is removed once opened, and the returned file has the name of the
+// original binary.
+func privateCopy(path string, binary []byte) (*os.File, error) {
+	dir, err := ioutil.TempDir("", "graceful-restart")
+	if err != nil {
+		return nil, fmt.Errorf("could not copy binary %s: %v", path, err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	copied := filepath.Join(dir, filepath.Base(path))
+	if err := ioutil.WriteFile(copied, binary, 0700); err != nil {
+		return nil, fmt.Errorf("could not copy binary %s: %v", path, err)
+	}
+	fd, err := syscall.Open(copied, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not open copy of binary %s: %v", path, err)
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// readSignature reads a detached ed25519 signature, either raw or base64 encoded
+func readSignature(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read signature: %v", err)
+	}
+	if len(b) == ed25519.SignatureSize {
+		return b, nil
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid signature file %s", path)
+	}
+	return signature, nil
+}
@@ -0,0 +1,149 @@
+package graceful
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeBinary writes a binary with the given contents in a temporary directory, and its signature if not nil
+func writeBinary(t *testing.T, contents string, signature []byte) string {
+	dir, err := ioutil.TempDir("", "graceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "app")
+	if err := ioutil.WriteFile(path, []byte(contents), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if signature != nil {
+		if err := ioutil.WriteFile(path+SignatureSuffix, signature, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestVerifyBinary(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const binary = "binary"
+	signature := ed25519.Sign(privateKey, []byte(binary))
+	sum := sha256.Sum256([]byte(binary))
+	checksum := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name         string
+		verification *Verification
+		signature    []byte
+		err          string
+	}{
+		{"no verification", nil, nil, ""},
+		{"empty verification", &Verification{}, nil, ""},
+		{"pinned", &Verification{SHA256: []string{"00", " " + strings.ToUpper(checksum) + "\n"}}, nil, ""},
+		{"not pinned", &Verification{SHA256: []string{"00"}}, signature, "is not pinned"},
+		{"signed", &Verification{PublicKey: publicKey}, signature, ""},
+		{"base64 signature", &Verification{PublicKey: publicKey},
+			[]byte(base64.StdEncoding.EncodeToString(signature) + "\n"), ""},
+		{"pinned without signature", &Verification{PublicKey: publicKey, SHA256: []string{checksum}}, nil, ""},
+		{"missing signature", &Verification{PublicKey: publicKey}, nil, "could not read signature"},
+		{"malformed signature", &Verification{PublicKey: publicKey}, []byte("not a signature"), "invalid signature file"},
+		{"signed with another key", &Verification{PublicKey: otherKey}, signature, "invalid signature for binary"},
+		{"signature of another binary", &Verification{PublicKey: publicKey},
+			ed25519.Sign(privateKey, []byte("other")), "invalid signature for binary"},
+		{"wrong key length", &Verification{PublicKey: publicKey[:16]}, signature, "invalid signature for binary"},
+	}
+	for _, test := range tests {
+		path := writeBinary(t, binary, test.signature)
+		s := New(Config{Verification: test.verification})
+		err := s.verifyBinary(path, []byte(binary))
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: got %v, want error %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestVerifyPrivateCopy(t *testing.T) {
+	path := writeBinary(t, "verified", nil)
+	link := filepath.Join(filepath.Dir(path), "current")
+	if err := os.Symlink(path, link); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("verified"))
+	s := New(Config{Verification: &Verification{SHA256: []string{hex.EncodeToString(sum[:])}}})
+
+	f, err := s.verify(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Name() != path {
+		t.Errorf("got binary %s, want the resolved path %s", f.Name(), path)
+	}
+
+	// Modifying the binary after verifying it has no effect on the file started
+	if err := ioutil.WriteFile(path, []byte("modified"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "verified" {
+		t.Errorf("read %q from the verified binary after modifying it", b)
+	}
+	original, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(original, copied) || copied.Mode().Perm()&0077 != 0 {
+		t.Errorf("got %s with mode %s, want a private copy of the binary", f.Name(), copied.Mode())
+	}
+
+	// A modified binary is refused
+	if _, err := s.verify(link); err == nil || !strings.Contains(err.Error(), "is not pinned") {
+		t.Errorf("got %v verifying a modified binary", err)
+	}
+}
+
+func TestExecPrivateCopy(t *testing.T) {
+	binary, err := ioutil.ReadFile(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(binary)
+	s := New(Config{Verification: &Verification{SHA256: []string{hex.EncodeToString(sum[:])}}})
+	f, err := s.verify(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// The copy runs with the arguments of this process, so it must not run any test
+	args := os.Args
+	os.Args = []string{args[0], "-test.run=^$"}
+	defer func() { os.Args = args }()
+	cmd := execCommand(f, readyFileDescriptor)
+	cmd.ExtraFiles = []*os.File{f}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("could not run the private copy of the binary: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,115 @@
+package graceful
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	defaultWatchDebounce = 500 * time.Millisecond
+
+	watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_ATTRIB
+)
+
+// watch returns a channel which receives a value whenever one of the watched files changes, once no more changes
+// happen for the debounce period. The directories of the files are watched with inotify rather than the files
+// themselves, since builds usually replace the file instead of writing to it. The channel is nil if nothing is watched.
+func (s *Supervisor) watch() (<-chan struct{}, error) {
+	if len(s.config.Watch) == 0 {
+		return nil, nil
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("could not watch files: %v", err)
+	}
+
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	watches := make(map[int32]string)
+	for _, path := range s.config.Watch {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("could not watch %s: %v", path, err)
+		}
+		files[path] = true
+
+		dir := filepath.Dir(path)
+		if dirs[dir] {
+			continue
+		}
+		wd, err := syscall.InotifyAddWatch(fd, dir, watchMask)
+		if err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("could not watch %s: %v", dir, err)
+		}
+		dirs[dir] = true
+		watches[int32(wd)] = dir
+	}
+
+	events := make(chan struct{})
+	go readInotify(fd, watches, files, events)
+
+	changes := make(chan struct{}, 1)
+	go debounce(events, changes, s.config.WatchDebounce)
+	return changes, nil
+}
+
+// readInotify sends a value to events for every inotify event on one of the given files, until reading fails.
+// Watches are the watched directories by watch descriptor.
+func readInotify(fd int, watches map[int32]string, files map[string]bool, events chan<- struct{}) {
+	defer syscall.Close(fd)
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			log.Printf("stopped watching files: %v", err)
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			if files[filepath.Join(watches[event.Wd], cString(name))] {
+				events <- struct{}{}
+			}
+		}
+	}
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// debounce sends a value to changes once no events have been received for the given period
+func debounce(events <-chan struct{}, changes chan<- struct{}, period time.Duration) {
+	timer := time.NewTimer(period)
+	timer.Stop()
+	for {
+		select {
+		case <-events:
+			timer.Reset(period)
+		case <-timer.C:
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -2,72 +2,204 @@ package main
 
 import (
 	"context"
-	"encoding/gob"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"os"
-	"os/exec"
-	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/rogerclotet/cqrs/argument"
 	"github.com/rogerclotet/cqrs/command"
 	"github.com/rogerclotet/cqrs/query"
+	"github.com/rogerclotet/graceful-restart/graceful"
+	"github.com/rogerclotet/graceful-restart/snapshot"
 )
 
-const inheritedFileDescriptor = 3
+// primarySocketEnv is the environment variable with the Unix socket where the primary worker receives the commands
+// forwarded by the other ones, set by the master so its workers use the same one when -primary-socket is not set
+const primarySocketEnv = "GRACEFUL_RESTART_PRIMARY_SOCKET"
+
+// snapshotKeysEnv is the environment variable with the snapshot encryption keys if -snapshot-keys is not set
+const snapshotKeysEnv = "SNAPSHOT_KEYS"
+
+// errHandedOff is the error of the commands which were held while taking the snapshot for a restart that succeeded,
+// since the new process took over without them
+var errHandedOff = errors.New("handed off to the new process, retry")
+
+// pendingCommand is a command waiting to be handled, which receives the result of handling it
+type pendingCommand struct {
+	command.Command
+	done chan error
+}
+
+// queueState is what a queue does with the elements it receives
+type queueState int
+
+const (
+	// queueHold holds the elements until the queue processes or rejects them
+	queueHold queueState = iota
+	// queueProcess passes the elements on to be handled
+	queueProcess
+	// queueReject rejects the elements with errHandedOff
+	queueReject
+)
 
 // Data is the app data to be stored in a snapshot
 type Data struct {
 	mu *sync.RWMutex
 	N  int
+	// LastCommand is when the last command was handled, added in schema version 2
+	LastCommand time.Time
+}
+
+// dataV1 is the data stored in snapshots of schema version 1
+type dataV1 struct {
+	N int
 }
 
-var wg sync.WaitGroup
+// dataSchema returns the schema of the snapshots of Data, with the migrations from the previous versions
+func dataSchema() *snapshot.Schema {
+	schema := &snapshot.Schema{Version: 2}
+	schema.Migrate(1, func() interface{} { return &dataV1{} }, func(old interface{}) (interface{}, error) {
+		// The time of the last command is unknown
+		return Data{N: old.(*dataV1).N}, nil
+	})
+	return schema
+}
 
 func (d *Data) increment() {
 	d.mu.Lock()
 	d.N++
+	d.LastCommand = time.Now()
 	d.mu.Unlock()
 }
 
 func main() {
-	fmt.Printf("hi! I'm %d\n", os.Getpid())
-
-	var graceful bool
-	flag.BoolVar(&graceful, "graceful", false, "restarting gracefully, internal use only")
+	var pidFile string
+	var master bool
+	var workers int
+	var watch bool
+	var watchFile string
+	var executable string
+	var publicKeyFile string
+	var checksums string
+	var archiveDir string
+	var snapshotInterval time.Duration
+	var snapshotEvery int
+	var keepSnapshots int
+	var codecName string
+	var snapshotLocation string
+	var lineageFile string
+	var keysFile string
+	var compressionName string
+	var chunkSize int
+	var primarySocket string
+	flag.StringVar(&pidFile, "pidfile", "", "path of the PID file")
+	flag.BoolVar(&master, "master", false, "run a master process which runs the app in worker processes")
+	flag.IntVar(&workers, "workers", 1, "number of worker processes in master mode")
+	flag.BoolVar(&watch, "watch", false, "restart when the executable changes, for development")
+	flag.StringVar(&watchFile, "watch-file", "", "additional file to watch with -watch, such as a configuration file")
+	flag.StringVar(&executable, "executable", "", "binary to start on restart, such as a symlink to the current release")
+	flag.StringVar(&publicKeyFile, "public-key", "",
+		"PEM encoded ed25519 public key which must sign the binary on restart")
+	flag.StringVar(&checksums, "sha256", "", "comma separated SHA-256 checksums of the binaries accepted on restart")
+	flag.StringVar(&archiveDir, "archive", "", "directory where the binaries are archived to roll back to them")
+	flag.DurationVar(&snapshotInterval, "snapshot-interval", 0, "how often to take a background snapshot")
+	flag.IntVar(&snapshotEvery, "snapshot-every", 0, "take a background snapshot every this many commands")
+	flag.IntVar(&keepSnapshots, "keep-snapshots", 3, "number of snapshots to keep to fall back to")
+	flag.StringVar(&codecName, "codec", "binary", fmt.Sprintf("snapshot codec, one of %v", snapshot.CodecNames()))
+	flag.StringVar(&compressionName, "compression", "gzip",
+		fmt.Sprintf("snapshot compression, one of %v", snapshot.CompressionNames()))
+	flag.IntVar(&chunkSize, "chunk-size", snapshot.DefaultChunkSize,
+		"size of the chunks snapshots are written and read in, which bounds the memory they take")
+	flag.StringVar(&snapshotLocation, "snapshot", "data.gob",
+		"snapshot location: a file path, kv:<path>#<name> or s3://<bucket>/<key>?endpoint=<url>&region=<region>")
+	flag.StringVar(&lineageFile, "lineage", "", "path of the lineage file, alongside the snapshot file by default")
+	flag.StringVar(&keysFile, "snapshot-keys", "",
+		"file with the <id>:<base64 AES key> entries to encrypt snapshots with, the first one being the current one, "+
+			"or "+snapshotKeysEnv+" if not set")
+	flag.StringVar(&primarySocket, "primary-socket", "",
+		"Unix socket where the primary worker receives the commands forwarded by the other workers, "+
+			"an abstract socket named after the master PID by default")
 	flag.Parse()
 
+	codec, err := snapshot.CodecByName(codecName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	compression, err := snapshot.CompressionByName(compressionName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	keys, err := snapshotKeys(keysFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	verification, err := newVerification(publicKeyFile, checksums)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var watched []string
+	if watch {
+		self, err := os.Executable()
+		if err != nil {
+			log.Fatalf("could not get executable path: %v", err)
+		}
+		watched = append(watched, self)
+		if watchFile != "" {
+			watched = append(watched, watchFile)
+		}
+	}
+
 	commands := make(chan interface{})
 	cmdToHandle := make(chan interface{})
 	queries := make(chan interface{})
 	qToHandle := make(chan interface{})
-	processCommands := make(chan bool)
-	processQueries := make(chan bool)
+	processCommands := make(chan queueState)
+	processQueries := make(chan queueState)
 
+	// wg counts the commands and queries passed on to be handled which are not handled yet
+	var wg sync.WaitGroup
 	ctx, cancel := context.WithCancel(context.Background())
-	go queue(ctx, commands, cmdToHandle, processCommands)
-	go queue(ctx, queries, qToHandle, processQueries)
-
-	http.Handle("/command", func() http.HandlerFunc {
-		return func(w http.ResponseWriter, r *http.Request) {
-			uq := r.URL.Query()
-			args := argsFromURLQuery(uq)
-			name, err := args.GetString("cmd")
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-			commands <- command.New(name, args)
+	defer cancel()
+	go queue(ctx, commands, cmdToHandle, processCommands, &wg)
+	go queue(ctx, queries, qToHandle, processQueries, &wg)
+
+	handleCommand := func(w http.ResponseWriter, r *http.Request) {
+		uq := r.URL.Query()
+		args := argsFromURLQuery(uq)
+		name, err := args.GetString("cmd")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
-	}())
+		// The command is only acknowledged once it is applied, so a command is never reported as handled and lost
+		c := pendingCommand{Command: command.New(name, args), done: make(chan error, 1)}
+		commands <- c
+		switch err := <-c.done; err {
+		case nil:
+		case errHandedOff:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
 
 	http.Handle("/query", func() http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
@@ -91,34 +223,136 @@ func main() {
 		}
 	}())
 
-	var l net.Listener
-	var err error
-	if graceful {
-		f := os.NewFile(inheritedFileDescriptor, "")
-		l, err = net.FileListener(f)
-		if err != nil {
-			log.Fatalf("could not listen to inherited socket: %v", err)
+	d := Data{
+		mu: &sync.RWMutex{},
+	}
+
+	snapshotLocation, err = snapshot.AbsLocation(snapshotLocation)
+	if err != nil {
+		log.Fatalf("could not get snapshot location: %v", err)
+	}
+	if _, _, err := snapshot.ParseLocation(snapshotLocation); err != nil {
+		log.Fatal(err)
+	}
+	if lineageFile == "" && !filepath.IsAbs(snapshotLocation) {
+		// The snapshot is not a file to save the lineage alongside
+		lineageFile = "data.lineage"
+	}
+
+	// The primary worker saves the snapshots restored by the other workers separately, keeping only the newest one
+	refreshLocation := snapshot.SuffixLocation(snapshotLocation, ".refresh")
+
+	schema := dataSchema()
+	snapshotFiles := func(location string) snapshot.Files {
+		keep := keepSnapshots
+		if location == refreshLocation {
+			keep = 1
 		}
-	} else {
-		l, err = net.Listen("tcp", ":8080")
-		if err != nil {
-			log.Fatalf("could not listen to TCP port 8080: %v", err)
+		return snapshot.Files{
+			Location:    location,
+			Keep:        keep,
+			Codec:       codec,
+			Schema:      schema,
+			Keys:        keys,
+			Compression: compression,
+			ChunkSize:   chunkSize,
 		}
 	}
 
-	server := &http.Server{
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 16,
+	if flag.Arg(0) == "snapshot" {
+		if err := runSnapshotCommand(flag.Args()[1:], snapshotLocation, snapshotFiles); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	netListener := newGracefulListener(l)
-
-	go func() {
-		_ = server.Serve(netListener)
-	}()
+	fmt.Printf("hi! I'm %d\n", os.Getpid())
 
-	d := restoreSnapshot()
+	adminMux := http.NewServeMux()
+	listeners := []graceful.Listener{
+		{
+			Name: "http",
+			Addr: ":8080",
+			Server: &http.Server{
+				ReadTimeout:    10 * time.Second,
+				WriteTimeout:   10 * time.Second,
+				MaxHeaderBytes: 1 << 16,
+			},
+		},
+		{
+			Name:   "admin",
+			Addr:   "127.0.0.1:8081",
+			Server: &http.Server{Handler: adminMux},
+		},
+	}
+	if master && workers > 1 {
+		if primarySocket == "" {
+			primarySocket = os.Getenv(primarySocketEnv)
+		}
+		if primarySocket == "" {
+			primarySocket = fmt.Sprintf("@graceful-restart-primary-%d", os.Getpid())
+			if err := os.Setenv(primarySocketEnv, primarySocket); err != nil {
+				log.Fatal(err)
+			}
+		}
+		listeners = append(listeners, graceful.Listener{
+			Name:        "primary",
+			Network:     "unix",
+			Addr:        primarySocket,
+			Server:      &http.Server{Handler: http.HandlerFunc(handleCommand)},
+			PrimaryOnly: true,
+		})
+	}
+	supervisor := graceful.New(graceful.Config{
+		Listeners:        listeners,
+		PIDFile:          pidFile,
+		Master:           master,
+		Workers:          workers,
+		Watch:            watched,
+		Executable:       executable,
+		Verification:     verification,
+		ArchiveDir:       archiveDir,
+		SnapshotInterval: snapshotInterval,
+		SnapshotLocation: snapshotLocation,
+		RefreshLocation:  refreshLocation,
+		LineageFile:      lineageFile,
+		Snapshot: func(location string) error {
+			return d.takeSnapshot(snapshotFiles(location))
+		},
+		Restore: func(location string) error {
+			return d.restoreSnapshot(snapshotFiles(location))
+		},
+		Check: func(location string) error {
+			return checkSnapshot(snapshotFiles(location))
+		},
+		Hooks: graceful.Hooks{
+			BeforeSnapshot: func() {
+				processCommands <- queueHold
+				wg.Wait()
+			},
+			AfterRestore: func() {
+				processQueries <- queueProcess
+				processCommands <- queueProcess
+			},
+			Resume: func() {
+				processCommands <- queueProcess
+			},
+			Handoff: func() {
+				processCommands <- queueReject
+			},
+		},
+	})
+
+	adminMux.Handle("/lineage", supervisor.LineageHandler())
+	adminMux.Handle("/upgrade", supervisor.UpgradeHandler())
+	adminMux.Handle("/rollback", supervisor.RollbackHandler())
+
+	// Only the primary worker handles commands, the other ones forward them to it
+	if supervisor.Primary() {
+		http.HandleFunc("/command", handleCommand)
+	} else {
+		http.Handle("/command", primaryProxy(primarySocket))
+	}
 
 	commandRegistry, err := command.NewRegistry(
 		command.NewRegisteredCommand("increment", incrementCommand(&d)),
@@ -129,104 +363,182 @@ func main() {
 
 	queryRegistry, err := query.NewRegistry(
 		query.NewRegisteredQuery("handled_commands", handledCommandsQuery(&d)),
+		query.NewRegisteredQuery("last_command", lastCommandQuery(&d)),
+		supervisor.LineageQuery(),
 	)
 	if err != nil {
 		log.Fatalf("could not create query registry: %v", err)
 	}
 
-	var wg sync.WaitGroup
 	handlerCtx := context.Background()
-	go commandHandler(handlerCtx, commandRegistry, cmdToHandle, &wg)
+	var handledCommands int
+	afterCommand := func() {
+		handledCommands++
+		if snapshotEvery > 0 && handledCommands%snapshotEvery == 0 {
+			supervisor.Checkpoint()
+		}
+	}
+	go commandHandler(handlerCtx, commandRegistry, cmdToHandle, &wg, afterCommand)
 	go queryHandler(handlerCtx, queryRegistry, qToHandle, &wg)
-	defer wg.Wait()
-
-	processQueries <- true
-	processCommands <- true
-
-	stop := make(chan os.Signal)
-	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
-	restart := make(chan os.Signal)
-	signal.Notify(restart, syscall.SIGHUP)
-
-	select {
-	case <-stop:
-		cancel()
-		wg.Wait()
-		d.takeSnapshot()
-	case <-restart:
-		cancel()
-		wg.Wait()
-		d.takeSnapshot()
-		startFork(netListener)
+
+	if err := supervisor.Listen(); err != nil {
+		log.Fatal(err)
+	}
+
+	if supervisor.IsMaster() {
+		if err := supervisor.RunMaster(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	go func() {
+		_ = supervisor.Serve()
+	}()
+
+	if err := supervisor.Restore(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := supervisor.Ready(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := supervisor.Wait(); err != nil {
+		log.Fatal(err)
 	}
 }
 
-func (d Data) takeSnapshot() {
-	path, _ := filepath.Abs("./data.gob")
-	file, err := os.Create(path)
+// takeSnapshot saves a snapshot of the data
+func (d *Data) takeSnapshot(files snapshot.Files) error {
+	// The state is copied so commands are only blocked while copying it, not while writing it
+	d.mu.RLock()
+	copied := Data{N: d.N, LastCommand: d.LastCommand}
+	d.mu.RUnlock()
+
+	return files.Save(copied)
+}
+
+// restoreSnapshot restores the newest valid snapshot, if there is any
+func (d *Data) restoreSnapshot(files snapshot.Files) error {
+	var restored Data
+	err := files.Load(&restored)
+	if err == snapshot.ErrNoSnapshot {
+		return nil
+	}
 	if err != nil {
-		log.Printf("failed to create snapshot: %v", err)
+		return err
 	}
 
-	_ = gob.NewEncoder(file).Encode(d)
+	d.mu.Lock()
+	d.N = restored.N
+	d.LastCommand = restored.LastCommand
+	d.mu.Unlock()
+	return nil
 }
 
-func restoreSnapshot() Data {
-	path, _ := filepath.Abs("./data.gob")
-	file, err := os.Open(path)
-	d := Data{
-		mu: &sync.RWMutex{},
+// checkSnapshot validates the newest snapshot without restoring it
+func checkSnapshot(files snapshot.Files) error {
+	var restored Data
+	err := files.Check(&restored)
+	if os.IsNotExist(err) {
+		return nil
 	}
-	if err == nil {
-		_ = gob.NewDecoder(file).Decode(&d)
+	return err
+}
+
+// Validate checks the data restored from a snapshot
+func (d *Data) Validate() error {
+	if d.N < 0 {
+		return fmt.Errorf("invalid number of handled commands %d", d.N)
 	}
-	return d
+	return nil
 }
 
-func startFork(l *gracefulListener) {
-	file := l.File()
+// newVerification returns the verification of the binaries with the public key in the given file and the given
+// checksums, or nil if there are none
+func newVerification(publicKeyFile, checksums string) (*graceful.Verification, error) {
+	var v graceful.Verification
+	if checksums != "" {
+		v.SHA256 = strings.Split(checksums, ",")
+	}
 
-	args := []string{}
-	if len(os.Args) > 1 {
-		args = append(args, os.Args[1:]...)
+	if publicKeyFile != "" {
+		b, err := ioutil.ReadFile(publicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read public key: %v", err)
+		}
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data in public key file %s", publicKeyFile)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse public key: %v", err)
+		}
+		publicKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key in %s is not an ed25519 key", publicKeyFile)
+		}
+		v.PublicKey = publicKey
 	}
-	args = append(args, "-graceful") // TODO avoid repeating flag after second reload
-	cmd := exec.Command(os.Args[0], args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.ExtraFiles = []*os.File{file}
 
-	err := cmd.Start()
-	if err != nil {
-		log.Fatalf("gracefulRestart: Failed to launch, error: %v", err)
+	if v.PublicKey == nil && v.SHA256 == nil {
+		return nil, nil
 	}
+	return &v, nil
+}
+
+// snapshotKeys returns the keys to encrypt snapshots with, read from the given file or from the environment, or nil if
+// there are none
+func snapshotKeys(keysFile string) (*snapshot.Keys, error) {
+	if keysFile != "" {
+		return snapshot.ReadKeys(keysFile)
+	}
+	if env := os.Getenv(snapshotKeysEnv); env != "" {
+		return snapshot.ParseKeys(env)
+	}
+	return nil, nil
+}
+
+// primaryProxy returns a handler which forwards requests to the primary worker listening on the given Unix socket
+func primaryProxy(addr string) http.Handler {
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: "primary"})
+	proxy.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", addr)
+		},
+	}
+	return proxy
 }
 
 func argsFromURLQuery(query url.Values) argument.Arguments {
-	var args argument.Arguments
+	args := make(argument.Arguments)
 	for k, v := range query {
-		args[k] = argument.New(v)
+		args[k] = argument.New(v[0])
 	}
 	return args
 }
 
-func queue(ctx context.Context, in chan interface{}, out chan interface{}, process chan bool) {
-	processing := false
+// queue passes the elements it receives on to be handled, holds them or rejects them depending on its state. Every
+// element passed on is added to wg before, so once a state is received every element passed on before it is counted.
+func queue(ctx context.Context, in chan interface{}, out chan interface{}, process chan queueState, wg *sync.WaitGroup) {
+	state := queueHold
 	var queue []interface{}
 
 	for {
 		select {
-		case p := <-process:
-			if p {
+		case state = <-process:
+			if state != queueHold {
 				for _, elem := range queue {
-					out <- elem
+					dispatch(elem, state, out, wg)
 				}
 				queue = []interface{}{}
 			}
-			processing = p
 		case elem := <-in:
-			if processing {
-				out <- elem
+			if state != queueHold {
+				dispatch(elem, state, out, wg)
 			} else {
 				queue = append(queue, elem)
 			}
@@ -236,20 +548,43 @@ func queue(ctx context.Context, in chan interface{}, out chan interface{}, proce
 	}
 }
 
-func commandHandler(ctx context.Context, r command.Registry, commands chan interface{}, wg *sync.WaitGroup) {
+// dispatch passes an element on to be handled, adding it to wg, or rejects it if the queue rejects its elements
+func dispatch(elem interface{}, state queueState, out chan interface{}, wg *sync.WaitGroup) {
+	if state == queueProcess {
+		wg.Add(1)
+		out <- elem
+		return
+	}
+	switch e := elem.(type) {
+	case pendingCommand:
+		e.done <- errHandedOff
+	case query.Query:
+		e.Respond(query.NewResponse(nil, errHandedOff))
+	}
+}
+
+func commandHandler(
+	ctx context.Context,
+	r command.Registry,
+	commands chan interface{},
+	wg *sync.WaitGroup,
+	afterCommand func(),
+) {
 	for receivedCommand := range commands {
-		c, ok := receivedCommand.(command.Command)
+		c, ok := receivedCommand.(pendingCommand)
 		if !ok {
 			log.Printf("received %v in command handler", receivedCommand)
+			wg.Done()
 			continue
 		}
 
-		wg.Add(1)
-		err := r.Handle(ctx, c)
+		err := r.Handle(ctx, c.Command)
 		if err != nil {
 			log.Printf("error handling command %s: %v", c.Name(), err)
 		}
+		c.done <- err
 		wg.Done()
+		afterCommand()
 	}
 }
 
@@ -266,10 +601,10 @@ func queryHandler(ctx context.Context, r query.Registry, queries chan interface{
 		q, ok := receivedQuery.(query.Query)
 		if !ok {
 			log.Printf("received %v in query handler", receivedQuery)
+			wg.Done()
 			continue
 		}
 
-		wg.Add(1)
 		res, err := r.Handle(ctx, q)
 		qr := query.NewResponse(res, err)
 		if err != nil {
@@ -289,51 +624,11 @@ func handledCommandsQuery(d *Data) query.Handler {
 	}
 }
 
-type gracefulListener struct {
-	net.Listener
-	stop chan error
-}
-
-func newGracefulListener(l net.Listener) (gl *gracefulListener) {
-	gl = &gracefulListener{Listener: l, stop: make(chan error)}
-	go func() {
-		_ = <-gl.stop
-		gl.stop <- gl.Listener.Close()
-	}()
-	return
-}
-
-func (gl *gracefulListener) Accept() (net.Conn, error) {
-	c, err := gl.Listener.Accept()
-	if err != nil {
-		return c, err
-	}
-
-	c = gracefulConnection{Conn: c}
-
-	wg.Add(1)
-	return c, err
-}
-
-func (gl *gracefulListener) Close() error {
-	gl.stop <- nil
-	return <-gl.stop
-}
+func lastCommandQuery(d *Data) query.Handler {
+	return func(_ context.Context, _ argument.Arguments) (interface{}, error) {
+		d.mu.RLock()
+		defer d.mu.RUnlock()
 
-func (gl *gracefulListener) File() *os.File {
-	tcpListener := gl.Listener.(*net.TCPListener)
-	f, err := tcpListener.File()
-	if err != nil {
-		log.Fatalf("could not get file descriptor for TCP socket: %v", err)
+		return d.LastCommand.Format(time.RFC3339Nano), nil
 	}
-	return f
-}
-
-type gracefulConnection struct {
-	net.Conn
-}
-
-func (w gracefulConnection) Close() error {
-	wg.Done()
-	return w.Conn.Close()
 }
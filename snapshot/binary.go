@@ -0,0 +1,542 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+const (
+	binaryVersion = 1
+	// maxBinaryDepth bounds how deeply values can be nested, so a malformed snapshot can not exhaust the stack
+	maxBinaryDepth = 1000
+)
+
+// Value tags of the binary format
+const (
+	tagNil byte = iota
+	tagBool
+	tagInt
+	tagUint
+	tagFloat
+	tagString
+	tagBytes
+	tagList
+	tagMap
+	tagStruct
+)
+
+// Binary encodes snapshots in a compact self-describing binary format. Every value is tagged with its type and struct
+// fields with their names, so values can be decoded without knowing their type, fields which were added or removed
+// since the snapshot was taken are ignored, and integer and float fields can change their size. Types implementing
+// encoding.BinaryMarshaler, such as time.Time, are encoded with it. Map keys decoded into interface{} must be
+// hashable, except for bytes which are decoded as strings.
+var Binary Codec = binaryCodec{}
+
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string {
+	return "binary"
+}
+
+func (binaryCodec) Encode(w io.Writer, v interface{}) error {
+	e := binaryEncoder{w: bufio.NewWriter(w)}
+	_ = e.w.WriteByte(binaryVersion)
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+func (binaryCodec) Decode(r io.Reader, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("can not decode into non-pointer %T", v)
+	}
+
+	d := binaryDecoder{r: bufio.NewReader(r)}
+	version, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != binaryVersion {
+		return fmt.Errorf("unsupported binary format version %d", version)
+	}
+	return d.decode(rv.Elem())
+}
+
+// binaryEncoder writes to a bufio.Writer, which keeps the first error and returns it when flushed, so the errors of
+// single writes can be ignored
+type binaryEncoder struct {
+	w *bufio.Writer
+}
+
+func (e binaryEncoder) uvarint(x uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	_, _ = e.w.Write(buf[:binary.PutUvarint(buf[:], x)])
+}
+
+func (e binaryEncoder) bytes(tag byte, b []byte) {
+	_ = e.w.WriteByte(tag)
+	e.uvarint(uint64(len(b)))
+	_, _ = e.w.Write(b)
+}
+
+func (e binaryEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		return e.w.WriteByte(tagNil)
+	}
+	if m, ok := binaryMarshaler(v); ok {
+		b, err := m.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		e.bytes(tagBytes, b)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return e.w.WriteByte(tagNil)
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		_ = e.w.WriteByte(tagBool)
+		if v.Bool() {
+			return e.w.WriteByte(1)
+		}
+		return e.w.WriteByte(0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		_ = e.w.WriteByte(tagInt)
+		var buf [binary.MaxVarintLen64]byte
+		_, err := e.w.Write(buf[:binary.PutVarint(buf[:], v.Int())])
+		return err
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		_ = e.w.WriteByte(tagUint)
+		e.uvarint(v.Uint())
+		return nil
+	case reflect.Float32, reflect.Float64:
+		_ = e.w.WriteByte(tagFloat)
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], math.Float64bits(v.Float()))
+		_, err := e.w.Write(buf[:])
+		return err
+	case reflect.String:
+		e.bytes(tagString, []byte(v.String()))
+		return nil
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			e.bytes(tagBytes, b)
+			return nil
+		}
+		_ = e.w.WriteByte(tagList)
+		e.uvarint(uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		_ = e.w.WriteByte(tagMap)
+		e.uvarint(uint64(v.Len()))
+		for _, key := range v.MapKeys() {
+			if err := e.encode(key); err != nil {
+				return err
+			}
+			if err := e.encode(v.MapIndex(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Struct:
+		fields := exportedFields(v.Type())
+		_ = e.w.WriteByte(tagStruct)
+		e.uvarint(uint64(len(fields)))
+		for _, i := range fields {
+			name := v.Type().Field(i).Name
+			e.uvarint(uint64(len(name)))
+			_, _ = e.w.WriteString(name)
+			if err := e.encode(v.Field(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("can not encode %s", v.Type())
+}
+
+func binaryMarshaler(v reflect.Value) (encoding.BinaryMarshaler, bool) {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil, false
+	}
+	if m, ok := v.Interface().(encoding.BinaryMarshaler); ok {
+		return m, true
+	}
+	if v.CanAddr() {
+		m, ok := v.Addr().Interface().(encoding.BinaryMarshaler)
+		return m, ok
+	}
+	return nil, false
+}
+
+func exportedFields(t reflect.Type) []int {
+	var fields []int
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" {
+			fields = append(fields, i)
+		}
+	}
+	return fields
+}
+
+type binaryDecoder struct {
+	r *bufio.Reader
+	// depth is how deeply the value being decoded is nested
+	depth int
+}
+
+// bytes reads a length and that many bytes. The buffer grows as the bytes are read, so a malformed length does not
+// allocate more than the input holds.
+func (d binaryDecoder) bytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return nil, err
+	}
+	if n > math.MaxInt32 {
+		return nil, fmt.Errorf("invalid length %d", n)
+	}
+	var b bytes.Buffer
+	if _, err := io.CopyN(&b, d.r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// decode decodes the next value into v, or skips it if v is not valid
+func (d binaryDecoder) decode(v reflect.Value) error {
+	if d.depth >= maxBinaryDepth {
+		return fmt.Errorf("values nested more than %d deep", maxBinaryDepth)
+	}
+	d.depth++
+	tag, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if tag == tagNil {
+		if v.IsValid() {
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	}
+
+	if v.IsValid() && v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	if v.IsValid() && tag == tagBytes && v.CanAddr() {
+		if u, ok := v.Addr().Interface().(encoding.BinaryUnmarshaler); ok {
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			return u.UnmarshalBinary(b)
+		}
+	}
+	if v.IsValid() && v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		generic, err := d.generic(tag)
+		if err != nil {
+			return err
+		}
+		if generic != nil {
+			v.Set(reflect.ValueOf(generic))
+		}
+		return nil
+	}
+
+	switch tag {
+	case tagBool:
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if !v.IsValid() {
+			return nil
+		}
+		if v.Kind() != reflect.Bool {
+			return mismatch("bool", v)
+		}
+		v.SetBool(b != 0)
+	case tagInt:
+		x, err := binary.ReadVarint(d.r)
+		if err != nil {
+			return err
+		}
+		return setInt(v, x)
+	case tagUint:
+		x, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return err
+		}
+		if x > math.MaxInt64 {
+			return setUint(v, x)
+		}
+		return setInt(v, int64(x))
+	case tagFloat:
+		var buf [8]byte
+		if _, err := io.ReadFull(d.r, buf[:]); err != nil {
+			return err
+		}
+		if !v.IsValid() {
+			return nil
+		}
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(buf[:])))
+		default:
+			return mismatch("float", v)
+		}
+	case tagString:
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		if !v.IsValid() {
+			return nil
+		}
+		if v.Kind() != reflect.String {
+			return mismatch("string", v)
+		}
+		v.SetString(string(b))
+	case tagBytes:
+		b, err := d.bytes()
+		if err != nil || !v.IsValid() {
+			return err
+		}
+		switch {
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(b)
+		case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+			reflect.Copy(v, reflect.ValueOf(b))
+		default:
+			return mismatch("bytes", v)
+		}
+	case tagList:
+		return d.list(v)
+	case tagMap:
+		return d.dict(v)
+	case tagStruct:
+		return d.structure(v)
+	default:
+		return fmt.Errorf("invalid value tag %d", tag)
+	}
+	return nil
+}
+
+func (d binaryDecoder) list(v reflect.Value) error {
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return err
+	}
+	if v.IsValid() && v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return mismatch("list", v)
+	}
+	if v.IsValid() && v.Kind() == reflect.Slice {
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+	}
+
+	for i := uint64(0); i < n; i++ {
+		var elem reflect.Value
+		switch {
+		case !v.IsValid():
+		case v.Kind() == reflect.Slice:
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			elem = v.Index(v.Len() - 1)
+		case int(i) < v.Len():
+			elem = v.Index(int(i))
+		}
+		if err := d.decode(elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d binaryDecoder) dict(v reflect.Value) error {
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return err
+	}
+	if v.IsValid() {
+		if v.Kind() != reflect.Map {
+			return mismatch("map", v)
+		}
+		v.Set(reflect.MakeMap(v.Type()))
+	}
+
+	for i := uint64(0); i < n; i++ {
+		var key, value reflect.Value
+		if v.IsValid() {
+			key = reflect.New(v.Type().Key()).Elem()
+			value = reflect.New(v.Type().Elem()).Elem()
+		}
+		if err := d.decode(key); err != nil {
+			return err
+		}
+		if err := d.decode(value); err != nil {
+			return err
+		}
+		if v.IsValid() && key.Kind() == reflect.Interface && !key.IsNil() && !key.Elem().Type().Comparable() {
+			b, ok := key.Interface().([]byte)
+			if !ok {
+				return fmt.Errorf("can not decode %s map key into %s", key.Elem().Type(), v.Type())
+			}
+			key = reflect.ValueOf(string(b))
+		}
+		if v.IsValid() {
+			v.SetMapIndex(key, value)
+		}
+	}
+	return nil
+}
+
+func (d binaryDecoder) structure(v reflect.Value) error {
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return err
+	}
+	if v.IsValid() && v.Kind() != reflect.Struct {
+		return mismatch("struct", v)
+	}
+
+	for i := uint64(0); i < n; i++ {
+		name, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		var field reflect.Value
+		if v.IsValid() {
+			if f, ok := v.Type().FieldByName(string(name)); ok && f.PkgPath == "" && len(f.Index) == 1 {
+				field = v.Field(f.Index[0])
+			}
+		}
+		if err := d.decode(field); err != nil {
+			return fmt.Errorf("field %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// generic decodes a value without knowing its type, as bool, int64, uint64, float64, string, []byte,
+// []interface{}, map[interface{}]interface{} or map[string]interface{} for structs. It is called with the tag just
+// read by decode.
+func (d binaryDecoder) generic(tag byte) (interface{}, error) {
+	switch tag {
+	case tagList:
+		var l []interface{}
+		err := d.list(reflect.ValueOf(&l).Elem())
+		return l, err
+	case tagMap:
+		m := make(map[interface{}]interface{})
+		err := d.dict(reflect.ValueOf(&m).Elem())
+		return m, err
+	case tagStruct:
+		n, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return nil, err
+		}
+		fields := make(map[string]interface{})
+		for i := uint64(0); i < n; i++ {
+			name, err := d.bytes()
+			if err != nil {
+				return nil, err
+			}
+			var value interface{}
+			if err := d.decode(reflect.ValueOf(&value).Elem()); err != nil {
+				return nil, err
+			}
+			fields[string(name)] = value
+		}
+		return fields, nil
+	}
+
+	// The tag was just read, so it can always be unread
+	_ = d.r.UnreadByte()
+	var value reflect.Value
+	switch tag {
+	case tagBool:
+		value = reflect.New(reflect.TypeOf(false)).Elem()
+	case tagInt:
+		value = reflect.New(reflect.TypeOf(int64(0))).Elem()
+	case tagUint:
+		value = reflect.New(reflect.TypeOf(uint64(0))).Elem()
+	case tagFloat:
+		value = reflect.New(reflect.TypeOf(float64(0))).Elem()
+	case tagString:
+		value = reflect.New(reflect.TypeOf("")).Elem()
+	case tagBytes:
+		value = reflect.New(reflect.TypeOf([]byte(nil))).Elem()
+	default:
+		return nil, fmt.Errorf("invalid value tag %d", tag)
+	}
+	if err := d.decode(value); err != nil {
+		return nil, err
+	}
+	return value.Interface(), nil
+}
+
+func setInt(v reflect.Value, x int64) error {
+	if !v.IsValid() {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(x) {
+			return fmt.Errorf("%d overflows %s", x, v.Type())
+		}
+		v.SetInt(x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if x < 0 {
+			return fmt.Errorf("%d overflows %s", x, v.Type())
+		}
+		return setUint(v, uint64(x))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(float64(x))
+	default:
+		return mismatch("integer", v)
+	}
+	return nil
+}
+
+func setUint(v reflect.Value, x uint64) error {
+	if !v.IsValid() {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.OverflowUint(x) {
+			return fmt.Errorf("%d overflows %s", x, v.Type())
+		}
+		v.SetUint(x)
+	default:
+		return mismatch("unsigned integer", v)
+	}
+	return nil
+}
+
+func mismatch(encoded string, v reflect.Value) error {
+	return fmt.Errorf("can not decode %s into %s", encoded, v.Type())
+}
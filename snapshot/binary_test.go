@@ -0,0 +1,247 @@
+package snapshot
+
+import (
+	"bytes"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+type binaryInner struct {
+	Label string
+	Score float32
+}
+
+type binaryValue struct {
+	Bool     bool
+	Int      int
+	Int8     int8
+	Int64    int64
+	Uint     uint
+	Uint16   uint16
+	Uint64   uint64
+	Float    float64
+	String   string
+	Bytes    []byte
+	Array    [4]byte
+	Ints     []int
+	Inners   []binaryInner
+	Fixed    [2]string
+	Map      map[string]int
+	Nested   map[int][]string
+	Pointer  *binaryInner
+	Nil      *binaryInner
+	Time     time.Time
+	Any      interface{}
+	unexport int
+}
+
+func binaryRoundTrip(t *testing.T, in, out interface{}) {
+	var buf bytes.Buffer
+	if err := Binary.Encode(&buf, in); err != nil {
+		t.Fatalf("could not encode %T: %v", in, err)
+	}
+	if err := Binary.Decode(&buf, out); err != nil {
+		t.Fatalf("could not decode into %T: %v", out, err)
+	}
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	in := binaryValue{
+		Bool:    true,
+		Int:     -1 << 40,
+		Int8:    -128,
+		Int64:   1<<63 - 1,
+		Uint:    7,
+		Uint16:  65535,
+		Uint64:  1<<64 - 1,
+		Float:   3.25,
+		String:  "snapshot ✓",
+		Bytes:   []byte{0, 1, 2},
+		Array:   [4]byte{1, 2, 3, 4},
+		Ints:    []int{1, -2, 3},
+		Inners:  []binaryInner{{"a", 1.5}, {"b", -2}},
+		Fixed:   [2]string{"x", "y"},
+		Map:     map[string]int{"one": 1, "two": 2},
+		Nested:  map[int][]string{1: {"a"}, 2: nil},
+		Pointer: &binaryInner{"p", 0.5},
+		Time:    time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC),
+		Any:     "dynamic",
+		// Unexported fields are not encoded
+		unexport: 1,
+	}
+
+	var out binaryValue
+	binaryRoundTrip(t, in, &out)
+	in.unexport = 0
+	// Empty slices decode as empty, not nil
+	in.Nested[2] = []string{}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("decoded\n%+v\nwant\n%+v", out, in)
+	}
+}
+
+func TestBinaryGeneric(t *testing.T) {
+	in := map[string]interface{}{
+		"list":   []interface{}{int64(1), "two", true},
+		"struct": binaryInner{"a", 2},
+		"uint":   uint64(1 << 63),
+		"bytes":  []byte("b"),
+	}
+
+	var out map[string]interface{}
+	binaryRoundTrip(t, in, &out)
+	want := map[string]interface{}{
+		"list":   []interface{}{int64(1), "two", true},
+		"struct": map[string]interface{}{"Label": "a", "Score": float64(2)},
+		"uint":   uint64(1 << 63),
+		"bytes":  []byte("b"),
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("decoded %#v, want %#v", out, want)
+	}
+}
+
+func TestBinaryGenericMapKeys(t *testing.T) {
+	var out interface{}
+	binaryRoundTrip(t, map[[2]byte]int{{'a', 'b'}: 1}, &out)
+	if want := map[interface{}]interface{}{"ab": int64(1)}; !reflect.DeepEqual(out, want) {
+		t.Errorf("decoded %#v, want %#v", out, want)
+	}
+
+	for _, in := range []interface{}{map[binaryInner]int{{"a", 1}: 1}, map[[2]int]int{{1, 2}: 1}} {
+		var buf bytes.Buffer
+		if err := Binary.Encode(&buf, in); err != nil {
+			t.Fatal(err)
+		}
+		if err := Binary.Decode(&buf, &out); err == nil || !strings.Contains(err.Error(), "map key") {
+			t.Errorf("got %v decoding %T into interface{}, want an error for its keys", err, in)
+		}
+	}
+}
+
+func TestBinarySchemaChanges(t *testing.T) {
+	type old struct {
+		Count   int8
+		Removed string
+		Skipped []binaryInner
+		Ratio   float32
+		Kept    map[string]bool
+	}
+	type current struct {
+		Count int64
+		Ratio float64
+		Kept  map[string]bool
+		Added string
+	}
+
+	var out current
+	binaryRoundTrip(t, old{
+		Count:   12,
+		Removed: "gone",
+		Skipped: []binaryInner{{"a", 1}},
+		Ratio:   0.5,
+		Kept:    map[string]bool{"k": true},
+	}, &out)
+	want := current{Count: 12, Ratio: 0.5, Kept: map[string]bool{"k": true}}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("decoded %+v, want %+v", out, want)
+	}
+}
+
+func TestBinaryDecodeErrors(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := Binary.Encode(&encoded, struct {
+		Small int
+		Name  string
+		Neg   int
+	}{300, "name", -1}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		into  interface{}
+		err   string
+	}{
+		{"empty", nil, new(int), "EOF"},
+		{"unsupported version", []byte{binaryVersion + 1, tagInt, 2}, new(int), "unsupported binary format version"},
+		{"invalid tag", []byte{binaryVersion, 0xee}, new(int), "invalid value tag"},
+		{"string into int", []byte{binaryVersion, tagString, 1, 'a'}, new(int), "can not decode string into int"},
+		{"list into struct", []byte{binaryVersion, tagList, 0}, new(binaryInner), "can not decode list into"},
+		{"overflow", encoded.Bytes(), new(struct{ Small int8 }), "overflows int8"},
+		{"negative into unsigned", encoded.Bytes(), new(struct{ Neg uint }), "overflows uint"},
+		{"field type changed", encoded.Bytes(), new(struct{ Name int }), "field Name"},
+		{"huge length", []byte{binaryVersion, tagString, 0xff, 0xff, 0xff, 0xff, 0x0f}, new(string), "invalid length"},
+	}
+	for _, test := range tests {
+		err := Binary.Decode(bytes.NewReader(test.input), test.into)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+
+	if err := Binary.Decode(bytes.NewReader(encoded.Bytes()), struct{}{}); err == nil {
+		t.Error("decoded into a non-pointer")
+	}
+}
+
+func TestBinaryMalformedLength(t *testing.T) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	before := stats.TotalAlloc
+
+	// A length of 1 GiB followed by a single byte
+	input := []byte{binaryVersion, tagString, 0x80, 0x80, 0x80, 0x80, 0x04, 'a'}
+	var out string
+	if err := Binary.Decode(bytes.NewReader(input), &out); err == nil {
+		t.Error("decoded a string longer than its input")
+	}
+	runtime.ReadMemStats(&stats)
+	if allocated := stats.TotalAlloc - before; allocated > 1<<20 {
+		t.Errorf("allocated %d bytes decoding %d bytes", allocated, len(input))
+	}
+}
+
+func TestBinaryNestingDepth(t *testing.T) {
+	nested := func(depth int) []byte {
+		input := []byte{binaryVersion}
+		for i := 0; i < depth; i++ {
+			input = append(input, tagList, 1)
+		}
+		return append(input, tagNil)
+	}
+
+	var out interface{}
+	if err := Binary.Decode(bytes.NewReader(nested(maxBinaryDepth-1)), &out); err != nil {
+		t.Errorf("could not decode lists nested %d deep: %v", maxBinaryDepth-1, err)
+	}
+	if err := Binary.Decode(bytes.NewReader(nested(1<<20)), &out); err == nil || !strings.Contains(err.Error(), "nested") {
+		t.Errorf("got %v decoding lists nested %d deep", err, 1<<20)
+	}
+}
+
+func TestBinaryTruncated(t *testing.T) {
+	in := binaryValue{String: "truncated", Ints: []int{1, 2, 3}, Map: map[string]int{"a": 1}, Time: time.Now()}
+	var buf bytes.Buffer
+	if err := Binary.Encode(&buf, in); err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := buf.Bytes()
+	for n := 0; n < len(encoded); n++ {
+		var out binaryValue
+		if err := Binary.Decode(bytes.NewReader(encoded[:n]), &out); err == nil {
+			t.Errorf("decoded a value truncated to %d of %d bytes", n, len(encoded))
+		}
+	}
+}
+
+func TestBinaryEncodeUnsupported(t *testing.T) {
+	if err := Binary.Encode(&bytes.Buffer{}, struct{ C chan int }{make(chan int)}); err == nil {
+		t.Error("encoded a channel")
+	}
+}
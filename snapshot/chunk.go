@@ -0,0 +1,203 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// DefaultChunkSize is the size of the chunks snapshot payloads are split in by default
+	DefaultChunkSize = 1 << 20
+	// maxChunkSize bounds the memory used to read a chunk, whatever length a corrupted file claims
+	maxChunkSize = 64 << 20
+	// maxChunkOverhead is the largest size an AEAD adds to a chunk, for a nonce and a tag
+	maxChunkOverhead = 12 + 16
+
+	chunkMore = 0
+	chunkLast = 1
+)
+
+// chunkWriter splits a payload in chunks, each one followed by its CRC-32 and encrypted separately if there is an
+// AEAD, so the payload can be written and read back with memory bounded by the chunk size. The last chunk is flagged,
+// and encrypted chunks authenticate their position and flag along with the header, so an encrypted payload can not be
+// truncated or reordered.
+type chunkWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	size   int
+	buf    []byte
+	index  uint64
+}
+
+func newChunkWriter(w io.Writer, aead cipher.AEAD, header []byte, size int) *chunkWriter {
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	if size > maxChunkSize {
+		size = maxChunkSize
+	}
+	return &chunkWriter{w: w, aead: aead, header: header, size: size}
+}
+
+// Write buffers p and writes every complete chunk but the last one, which is only known when closing
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	for len(c.buf) > c.size {
+		if err := c.writeChunk(c.buf[:c.size], chunkMore); err != nil {
+			return 0, err
+		}
+		c.buf = append(c.buf[:0], c.buf[c.size:]...)
+	}
+	return len(p), nil
+}
+
+// Close writes the last chunk
+func (c *chunkWriter) Close() error {
+	return c.writeChunk(c.buf, chunkLast)
+}
+
+func (c *chunkWriter) writeChunk(data []byte, flag byte) error {
+	if c.aead != nil {
+		nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(data)+c.aead.Overhead())
+		if _, err := rand.Read(nonce); err != nil {
+			return fmt.Errorf("could not generate nonce: %v", err)
+		}
+		data = c.aead.Seal(nonce, nonce, data, chunkData(c.header, c.index, flag))
+	}
+	c.index++
+
+	var prefix [1 + binary.MaxVarintLen64]byte
+	prefix[0] = flag
+	n := 1 + binary.PutUvarint(prefix[1:], uint64(len(data)))
+	sum := crc32.NewIEEE()
+	_, _ = sum.Write(prefix[:n])
+	_, _ = sum.Write(data)
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], sum.Sum32())
+
+	for _, b := range [][]byte{prefix[:n], data, checksum[:]} {
+		if _, err := c.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkReader reads a payload written by chunkWriter, verifying the CRC-32 of every chunk before using it and the
+// SHA-256 checksum of the whole file after the last chunk. Chunks are decrypted if there is an AEAD, and returned as
+// they are otherwise. Errors are sticky, so the cause of a failed decoding can be told apart.
+type chunkReader struct {
+	r      *bufio.Reader
+	sum    hash.Hash
+	aead   cipher.AEAD
+	keyID  string
+	header []byte
+	index  uint64
+	buf    []byte
+	last   bool
+	err    error
+	// checksum is the SHA-256 checksum of the file, set once it is verified
+	checksum []byte
+}
+
+// newChunkReader returns a reader of the chunks in r, where sum has hashed the file from after the magic number to
+// the first chunk
+func newChunkReader(r *bufio.Reader, sum hash.Hash, aead cipher.AEAD, keyID string, header []byte) *chunkReader {
+	return &chunkReader{r: r, sum: sum, aead: aead, keyID: keyID, header: header}
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 && c.err == nil {
+		if c.last {
+			c.err = c.verify()
+			break
+		}
+		c.buf, c.err = c.readChunk()
+	}
+	if len(c.buf) > 0 {
+		n := copy(p, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	return 0, c.err
+}
+
+func (c *chunkReader) readChunk() ([]byte, error) {
+	flag, err := c.r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("truncated snapshot")
+	}
+	size, err := binary.ReadUvarint(c.r)
+	if err != nil || flag > chunkLast {
+		return nil, fmt.Errorf("invalid snapshot chunk")
+	}
+	if size > maxChunkSize+maxChunkOverhead {
+		return nil, fmt.Errorf("snapshot chunk too large")
+	}
+	data := make([]byte, size)
+	var checksum [4]byte
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, fmt.Errorf("truncated snapshot")
+	}
+	if _, err := io.ReadFull(c.r, checksum[:]); err != nil {
+		return nil, fmt.Errorf("truncated snapshot")
+	}
+
+	var prefix [1 + binary.MaxVarintLen64]byte
+	prefix[0] = flag
+	n := 1 + binary.PutUvarint(prefix[1:], size)
+	sum := crc32.NewIEEE()
+	_, _ = sum.Write(prefix[:n])
+	_, _ = sum.Write(data)
+	if binary.BigEndian.Uint32(checksum[:]) != sum.Sum32() {
+		return nil, fmt.Errorf("checksum mismatch in chunk %d", c.index)
+	}
+	_, _ = c.sum.Write(prefix[:n])
+	_, _ = c.sum.Write(data)
+	_, _ = c.sum.Write(checksum[:])
+
+	if c.aead != nil {
+		if len(data) < c.aead.NonceSize() {
+			return nil, &KeyError{ID: c.keyID, Err: fmt.Errorf("truncated ciphertext")}
+		}
+		nonce, ciphertext := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+		data, err = c.aead.Open(ciphertext[:0], nonce, ciphertext, chunkData(c.header, c.index, flag))
+		if err != nil {
+			return nil, &KeyError{ID: c.keyID, Err: fmt.Errorf("wrong key or tampered snapshot")}
+		}
+	}
+	c.index++
+	c.last = flag == chunkLast
+	return data, nil
+}
+
+// verify reads the checksum after the last chunk and compares it with the one of the file
+func (c *chunkReader) verify() error {
+	checksum := make([]byte, c.sum.Size())
+	if _, err := io.ReadFull(c.r, checksum); err != nil {
+		return fmt.Errorf("truncated snapshot")
+	}
+	if !bytes.Equal(checksum, c.sum.Sum(nil)) {
+		return fmt.Errorf("checksum mismatch")
+	}
+	c.checksum = checksum
+	return io.EOF
+}
+
+// chunkData returns the additional data authenticated with an encrypted chunk: the header, the position of the chunk
+// and whether it is the last one
+func chunkData(header []byte, index uint64, flag byte) []byte {
+	data := make([]byte, len(header), len(header)+9)
+	copy(data, header)
+	var position [8]byte
+	binary.BigEndian.PutUint64(position[:], index)
+	return append(append(data, position[:]...), flag)
+}
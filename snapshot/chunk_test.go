@@ -0,0 +1,221 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// rawChunk is a chunk of a snapshot file as it is written, encrypted if the snapshot is
+type rawChunk struct {
+	flag byte
+	data []byte
+}
+
+// splitChunks splits a snapshot file in its magic number and header, its chunks and its checksum
+func splitChunks(t *testing.T, b []byte) ([]byte, []rawChunk, []byte) {
+	r := bytes.NewReader(b[len(magic):])
+	skipName := func() {
+		n, _ := r.ReadByte()
+		_, _ = r.Seek(int64(n), 1)
+	}
+	skipName()
+	if _, err := binary.ReadUvarint(r); err != nil {
+		t.Fatal(err)
+	}
+	skipName()
+	skipName()
+	head := b[:len(b)-r.Len()]
+
+	var chunks []rawChunk
+	for {
+		flag, err := r.ReadByte()
+		if err != nil {
+			t.Fatal("no last chunk")
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, size)
+		_, _ = r.Read(data)
+		_, _ = r.Seek(4, 1)
+		chunks = append(chunks, rawChunk{flag, data})
+		if flag == chunkLast {
+			break
+		}
+	}
+	return head, chunks, b[len(b)-r.Len():]
+}
+
+// joinChunks is the reverse of splitChunks, with the CRC-32 of every chunk computed again so they are only detected
+// by their content
+func joinChunks(head []byte, chunks []rawChunk, sum []byte) []byte {
+	b := append([]byte{}, head...)
+	for _, c := range chunks {
+		start := len(b)
+		var size [binary.MaxVarintLen64]byte
+		b = append(append(b, c.flag), size[:binary.PutUvarint(size[:], uint64(len(c.data)))]...)
+		b = append(b, c.data...)
+		var checksum [4]byte
+		binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(b[start:]))
+		b = append(b, checksum[:]...)
+	}
+	return append(b, sum...)
+}
+
+// rewriteChunks replaces the chunks of the snapshot file at the given path with the ones returned by rewrite
+func rewriteChunks(t *testing.T, path string, rewrite func([]rawChunk) []rawChunk) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, chunks, sum := splitChunks(t, b)
+	if err := ioutil.WriteFile(path, joinChunks(head, rewrite(chunks), sum), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChunkSizes(t *testing.T) {
+	value := testData{N: 1, Name: strings.Repeat("chunked ", 100)}
+	for _, keys := range []*Keys{nil, testKeys(t, "k1")} {
+		for _, compression := range []Compression{nil, Gzip} {
+			for _, size := range []int{1, 7, 4096} {
+				newest := filepath.Join(tempDir(t), "data.gob")
+				files := Files{Location: newest, Keys: keys, Compression: compression, ChunkSize: size}
+				saveAll(t, files, value)
+
+				var loaded testData
+				if err := files.Check(&loaded); err != nil {
+					t.Fatalf("could not load snapshot with chunks of %d bytes: %v", size, err)
+				}
+				if loaded != value {
+					t.Errorf("loaded %v from snapshot with chunks of %d bytes", loaded, size)
+				}
+
+				b, err := ioutil.ReadFile(newest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, chunks, _ := splitChunks(t, b)
+				if compression == nil && size == 1 && len(chunks) < len(value.Name) {
+					t.Errorf("wrote %d chunks of 1 byte", len(chunks))
+				}
+			}
+		}
+	}
+}
+
+func TestChunksTruncated(t *testing.T) {
+	for _, keys := range []*Keys{nil, testKeys(t, "k1")} {
+		newest := filepath.Join(tempDir(t), "data.gob")
+		files := Files{Location: newest, Keys: keys, ChunkSize: 16}
+		saveAll(t, files, testData{N: 1, Name: "truncated snapshot"})
+		b, err := ioutil.ReadFile(newest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for n := 0; n < len(b); n++ {
+			if err := ioutil.WriteFile(newest, b[:n], 0644); err != nil {
+				t.Fatal(err)
+			}
+			var loaded testData
+			if err := files.Check(&loaded); err == nil {
+				t.Fatalf("loaded a snapshot truncated to %d of %d bytes", n, len(b))
+			}
+		}
+	}
+}
+
+func TestChunksRewritten(t *testing.T) {
+	tests := []struct {
+		name    string
+		rewrite func([]rawChunk) []rawChunk
+	}{
+		{"reordered", func(c []rawChunk) []rawChunk {
+			c[0], c[1] = c[1], c[0]
+			return c
+		}},
+		{"duplicated", func(c []rawChunk) []rawChunk {
+			return append(c[:2], c[1:]...)
+		}},
+		{"dropped", func(c []rawChunk) []rawChunk {
+			return append(c[:1], c[2:]...)
+		}},
+		{"truncated at a chunk", func(c []rawChunk) []rawChunk {
+			c[1].flag = chunkLast
+			return c[:2]
+		}},
+		{"extended", func(c []rawChunk) []rawChunk {
+			last := c[len(c)-1]
+			c[len(c)-1].flag = chunkMore
+			return append(c, last)
+		}},
+	}
+	for _, test := range tests {
+		for _, keys := range []*Keys{nil, testKeys(t, "k1")} {
+			newest := filepath.Join(tempDir(t), "data.gob")
+			files := Files{Location: newest, Keys: keys, ChunkSize: 8}
+			saveAll(t, files, testData{N: 1, Name: "rewritten snapshot"})
+			rewriteChunks(t, newest, test.rewrite)
+
+			var loaded testData
+			err := files.Check(&loaded)
+			if err == nil {
+				t.Errorf("%s: loaded %v from rewritten snapshot", test.name, loaded)
+				continue
+			}
+			// Encrypted chunks are authenticated with their position, so they are not even decoded
+			if _, ok := err.(*KeyError); keys != nil && !ok {
+				t.Errorf("%s: got %v loading rewritten encrypted snapshot, want a *KeyError", test.name, err)
+			}
+		}
+	}
+}
+
+func TestChunkTooLarge(t *testing.T) {
+	newest := filepath.Join(tempDir(t), "data.gob")
+	files := Files{Location: newest}
+	saveAll(t, files, testData{N: 1})
+	b, err := ioutil.ReadFile(newest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, _, _ := splitChunks(t, b)
+	var size [binary.MaxVarintLen64]byte
+	huge := append(append(head, chunkLast), size[:binary.PutUvarint(size[:], 1<<40)]...)
+	if err := ioutil.WriteFile(newest, huge, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var loaded testData
+	if err := files.Check(&loaded); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("got %v loading a chunk claiming to be huge", err)
+	}
+}
+
+func TestLoadFallsBackOnCorruptedChunk(t *testing.T) {
+	newest := filepath.Join(tempDir(t), "data.gob")
+	files := Files{Location: newest, ChunkSize: 8}
+	saveAll(t, files, testData{N: 1, Name: "previous"}, testData{N: 2, Name: "corrupted"})
+	b, err := ioutil.ReadFile(newest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, _, _ := splitChunks(t, b)
+	// The second byte of data of the second chunk, after the flag and size of the first one and its CRC-32
+	corrupt(t, newest, len(head)+2+8+4+3)
+
+	var loaded testData
+	if err := files.Check(&loaded); err == nil || !strings.Contains(err.Error(), "checksum mismatch in chunk 1") {
+		t.Errorf("got %v checking a snapshot with a corrupted chunk", err)
+	}
+	if err := files.Load(&loaded); err != nil || loaded.N != 1 {
+		t.Errorf("loaded %v, %v, want the previous snapshot", loaded, err)
+	}
+}
@@ -0,0 +1,79 @@
+package snapshot
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Codec encodes and decodes the values saved in snapshots. Its name is recorded in the snapshot header, so a snapshot
+// is always decoded with the codec it was encoded with.
+type Codec interface {
+	// Name identifies the codec in snapshot headers
+	Name() string
+	// Encode writes the encoded value to w
+	Encode(w io.Writer, v interface{}) error
+	// Decode reads an encoded value from r into v, which is a pointer
+	Decode(r io.Reader, v interface{}) error
+}
+
+// Gob encodes snapshots with encoding/gob
+var Gob Codec = gobCodec{}
+
+// JSON encodes snapshots with encoding/json, so they can be read by other tools
+var JSON Codec = jsonCodec{}
+
+var codecs = map[string]Codec{
+	Gob.Name():    Gob,
+	JSON.Name():   JSON,
+	Binary.Name(): Binary,
+}
+
+// CodecByName returns the codec with the given name
+func CodecByName(name string) (Codec, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown snapshot codec %q, expected one of %v", name, CodecNames())
+	}
+	return c, nil
+}
+
+// CodecNames returns the names of the available codecs
+func CodecNames() []string {
+	var names []string
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Encode(w io.Writer, v interface{}) error {
+	return gob.NewEncoder(w).Encode(v)
+}
+
+func (gobCodec) Decode(r io.Reader, v interface{}) error {
+	return gob.NewDecoder(r).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (jsonCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
@@ -0,0 +1,62 @@
+package snapshot
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Compression compresses the encoded values saved in snapshots as a stream. Its name is recorded in the snapshot
+// header, so a snapshot is always decompressed with the compression it was written with.
+type Compression interface {
+	// Name identifies the compression in snapshot headers
+	Name() string
+	// NewWriter returns a writer which compresses to w, and flushes everything to it when closed
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// NewReader returns a reader which decompresses r
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Gzip compresses snapshots with compress/gzip
+var Gzip Compression = gzipCompression{}
+
+var compressions = map[string]Compression{
+	Gzip.Name(): Gzip,
+}
+
+// CompressionByName returns the compression with the given name, or nil for "none"
+func CompressionByName(name string) (Compression, error) {
+	if name == "none" {
+		return nil, nil
+	}
+	c, ok := compressions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown snapshot compression %q, expected one of %v", name, CompressionNames())
+	}
+	return c, nil
+}
+
+// CompressionNames returns the names of the available compressions, sorted, including "none"
+func CompressionNames() []string {
+	names := []string{"none"}
+	for name := range compressions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type gzipCompression struct{}
+
+func (gzipCompression) Name() string {
+	return "gzip"
+}
+
+func (gzipCompression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCompression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
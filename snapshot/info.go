@@ -0,0 +1,85 @@
+package snapshot
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Info describes a snapshot file
+type Info struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// Format is the version of the file format, 0 for a gob file written before snapshot files had a format
+	Format        int    `json:"format,omitempty"`
+	Codec         string `json:"codec,omitempty"`
+	SchemaVersion int    `json:"schema_version,omitempty"`
+	// KeyID is the ID of the key the snapshot is encrypted with, or empty if it is not encrypted
+	KeyID string `json:"key_id,omitempty"`
+	// Compression is the name of the compression of the snapshot, or empty if it is not compressed
+	Compression string `json:"compression,omitempty"`
+	// Checksum is the hex encoded SHA-256 checksum recorded in the file, or empty if it has none
+	Checksum string `json:"checksum,omitempty"`
+	// Error is why the snapshot can not be read, or empty if its checksum and header are valid
+	Error string `json:"error,omitempty"`
+}
+
+// Inspect returns the descriptions of the existing snapshots, newest first. It sets the Error of a description if it
+// is not a valid snapshot.
+func (f Files) Inspect() ([]Info, error) {
+	store, newest, err := f.store()
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []Info
+	for age := 0; age < f.keep(); age++ {
+		name := agedName(newest, age)
+		size, modTime, err := store.Stat(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		info := Info{
+			Name:    name,
+			Size:    size,
+			ModTime: modTime,
+		}
+
+		if err := inspect(store, name, &info); err != nil {
+			info.Error = err.Error()
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// inspect fills the description of the snapshot with the given name from its header, and verifies the checksums of
+// the whole file without decrypting it
+func inspect(store Store, name string, info *Info) error {
+	h, body, closer, err := openFile(store, name, nil, false)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	info.Format = h.format
+	info.Codec = h.codec.Name()
+	info.SchemaVersion = h.version
+	info.KeyID = h.keyID
+	if h.compression != nil {
+		info.Compression = h.compression.Name()
+	}
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return err
+	}
+	if chunks, ok := body.(*chunkReader); ok {
+		info.Checksum = hex.EncodeToString(chunks.checksum)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package snapshot
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Keys are the AES keys snapshots are encrypted with using AES-GCM, by ID. The ID of the key is recorded in the
+// snapshot header, so keys can be rotated: new snapshots are encrypted with the current key, and older snapshots are
+// decrypted with the key they were encrypted with as long as it is kept.
+type Keys struct {
+	// Current is the ID of the key new snapshots are encrypted with
+	Current string
+	// Keys are the keys by ID, 16, 24 or 32 bytes long for AES-128, AES-192 or AES-256
+	Keys map[string][]byte
+}
+
+// KeyError is returned when an encrypted snapshot can not be decrypted, because its key is unknown or wrong, or it
+// was tampered with
+type KeyError struct {
+	ID  string
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("could not decrypt snapshot encrypted with key %q: %v", e.ID, e.Err)
+}
+
+// ParseKeys parses keys given as "<id>:<base64 key>" entries separated by commas or new lines, where the first one is
+// the current one. Empty lines and lines starting with # are ignored.
+func ParseKeys(s string) (*Keys, error) {
+	keys := &Keys{Keys: make(map[string][]byte)}
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || len(parts[0]) > 255 {
+			return nil, fmt.Errorf("invalid snapshot key entry, expected <id>:<base64 key>")
+		}
+		id := parts[0]
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid snapshot key %q: %v", id, err)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("invalid snapshot key %q: %v", id, err)
+		}
+		if _, ok := keys.Keys[id]; ok {
+			return nil, fmt.Errorf("duplicate snapshot key %q", id)
+		}
+		if keys.Current == "" {
+			keys.Current = id
+		}
+		keys.Keys[id] = key
+	}
+	if keys.Current == "" {
+		return nil, fmt.Errorf("no snapshot keys")
+	}
+	return keys, nil
+}
+
+// ReadKeys reads the keys in the file at the given path, in the format of ParseKeys
+func ReadKeys(path string) (*Keys, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read snapshot keys: %v", err)
+	}
+	return ParseKeys(string(b))
+}
+
+func (k *Keys) aead(id string) (cipher.AEAD, error) {
+	if k == nil {
+		return nil, &KeyError{ID: id, Err: fmt.Errorf("no snapshot keys configured")}
+	}
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, &KeyError{ID: id, Err: fmt.Errorf("unknown key")}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, &KeyError{ID: id, Err: err}
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,155 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testKey returns a base64 encoded AES-256 key made of the given byte
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+// testKeys returns keys with the given IDs, where the first one is the current one
+func testKeys(t *testing.T, ids ...string) *Keys {
+	var entries []string
+	for i, id := range ids {
+		entries = append(entries, id+":"+testKey(byte(i+1)))
+	}
+	keys, err := ParseKeys(strings.Join(entries, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys("# rotated on 2020-01-02\nnew:" + testKey(2) + "\n\n old : " + testKey(1) + " ,aes128:" +
+		base64.StdEncoding.EncodeToString(make([]byte, 16)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.Current != "new" || len(keys.Keys) != 3 || len(keys.Keys["aes128"]) != 16 {
+		t.Errorf("parsed %+v", keys)
+	}
+	if _, ok := keys.Keys["old "]; !ok {
+		t.Error("the ID of a key was trimmed")
+	}
+
+	tests := []struct {
+		name string
+		keys string
+		err  string
+	}{
+		{"empty", "", "no snapshot keys"},
+		{"only comments", "# none yet\n", "no snapshot keys"},
+		{"no ID", ":" + testKey(1), "invalid snapshot key entry"},
+		{"no key", "k1", "invalid snapshot key entry"},
+		{"long ID", strings.Repeat("k", 256) + ":" + testKey(1), "invalid snapshot key entry"},
+		{"bad base64", "k1:not base64!", "invalid snapshot key \"k1\""},
+		{"bad length", "k1:" + base64.StdEncoding.EncodeToString(make([]byte, 20)), "invalid key size"},
+		{"duplicate", "k1:" + testKey(1) + ",k1:" + testKey(2), "duplicate snapshot key \"k1\""},
+	}
+	for _, test := range tests {
+		_, err := ParseKeys(test.keys)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestEncryptedSaveLoad(t *testing.T) {
+	newest := filepath.Join(tempDir(t), "data.gob")
+	files := Files{Location: newest, Keys: testKeys(t, "k1")}
+	saveAll(t, files, testData{N: 1, Name: "secret"})
+
+	b, err := ioutil.ReadFile(newest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("secret")) {
+		t.Error("the snapshot was written in the clear")
+	}
+
+	// Rotating the key keeps the previous one to decrypt older snapshots
+	files.Keys = testKeys(t, "k2", "k1")
+	files.Keys.Keys["k1"] = bytes.Repeat([]byte{1}, 32)
+	var loaded testData
+	if err := files.Load(&loaded); err != nil || loaded != (testData{N: 1, Name: "secret"}) {
+		t.Errorf("loaded %v, %v after rotating the key", loaded, err)
+	}
+	saveAll(t, files, testData{N: 2})
+
+	infos, err := Files{Location: newest}.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].KeyID != "k2" || infos[1].KeyID != "k1" {
+		t.Fatalf("got %+v inspecting encrypted snapshots", infos)
+	}
+	for _, info := range infos {
+		if info.Error != "" || info.Checksum == "" {
+			t.Errorf("got %+v inspecting encrypted snapshot without keys", info)
+		}
+	}
+
+	// Snapshots written in the clear can always be read
+	plain := filepath.Join(tempDir(t), "data.gob")
+	saveAll(t, Files{Location: plain}, testData{N: 3})
+	if err := (Files{Location: plain, Keys: files.Keys}).Load(&loaded); err != nil || loaded.N != 3 {
+		t.Errorf("loaded %v, %v from snapshot in the clear with keys", loaded, err)
+	}
+}
+
+func TestLoadKeyErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		keys *Keys
+		// damage damages the newest snapshot
+		damage func(newest string)
+	}{
+		{"no keys", nil, func(string) {}},
+		{"unknown key", testKeys(t, "k2"), func(string) {}},
+		{"wrong key", &Keys{Current: "k1", Keys: map[string][]byte{"k1": make([]byte, 32)}}, func(string) {}},
+		{"tampered chunk", testKeys(t, "k1"), func(newest string) {
+			rewriteChunks(t, newest, func(c []rawChunk) []rawChunk {
+				c[0].data[len(c[0].data)-1] ^= 0xff
+				return c
+			})
+		}},
+		{"tampered header", testKeys(t, "k1"), func(newest string) {
+			b, err := ioutil.ReadFile(newest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			head, chunks, sum := splitChunks(t, b)
+			// The schema version follows the codec name, and an older one is migrated after decrypting it
+			head[len(magic)+1+len("gob")]--
+			if err := ioutil.WriteFile(newest, joinChunks(head, chunks, sum), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, test := range tests {
+		newest := filepath.Join(tempDir(t), "data.gob")
+		schema := &Schema{Version: 2}
+		schema.Migrate(1, func() interface{} { return &testData{} }, func(old interface{}) (interface{}, error) {
+			return *old.(*testData), nil
+		})
+		files := Files{Location: newest, Keys: testKeys(t, "k1"), Schema: schema}
+		saveAll(t, files, testData{N: 1}, testData{N: 2})
+		test.damage(newest)
+
+		// The previous snapshot is encrypted with the same key, so falling back would hide the error
+		files.Keys = test.keys
+		var loaded testData
+		err := files.Load(&loaded)
+		if _, ok := err.(*KeyError); !ok {
+			t.Errorf("%s: got %v, want a *KeyError", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+const (
+	kvLockSuffix = ".lock"
+	// kvCompactSize is the size from which a key-value file is compacted when most of it is overwritten records
+	kvCompactSize = 1 << 20
+
+	kvPut    = 0
+	kvDelete = 1
+	// kvHeaderSize is the size of a record header without its key: the operation, the key length, the modification
+	// time and the value length
+	kvHeaderSize = 1 + 2 + 8 + 8
+)
+
+var kvMagic = []byte("GRKV\x00\x00\x00\x01")
+
+// KVFile stores snapshot files as keys in a single append-only file at the given path, so a whole set of snapshots is
+// kept in one embedded file. Every record is checksummed, and a record left incomplete by a crash is ignored and
+// overwritten by the next one, while a corrupted record fails to be read without hiding the other ones. Overwritten records are discarded by rewriting the file once they take most of it.
+//
+// Access from several processes is serialized with a lock on the path followed by ".lock".
+type KVFile string
+
+// kvRecord is a record in a key-value file
+type kvRecord struct {
+	name    string
+	op      byte
+	offset  int64
+	end     int64
+	value   int64
+	size    int64
+	modTime time.Time
+	// corrupted is whether the record does not match its checksum
+	corrupted bool
+}
+
+// Open opens the snapshot file with the given name
+func (kv KVFile) Open(name string) (io.ReadCloser, error) {
+	unlock, err := kv.lock(syscall.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	f, err := os.Open(string(kv))
+	if err != nil {
+		return nil, err
+	}
+	records, _, err := scanKV(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r, ok := records[name]
+	if !ok {
+		f.Close()
+		return nil, kv.notExist(name)
+	}
+	if r.corrupted {
+		f.Close()
+		return nil, fmt.Errorf("corrupted record %s in %s", name, string(kv))
+	}
+
+	// Records are never modified once written, and compacting replaces the file instead of rewriting it
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, r.value, r.size), f}, nil
+}
+
+// Put appends the snapshot file with the given name
+func (kv KVFile) Put(name string, r io.Reader) error {
+	if len(name) > 1<<16-1 {
+		return fmt.Errorf("snapshot name too long")
+	}
+	return kv.update(func(f *os.File, end int64) error {
+		return appendKV(f, end, kvPut, name, r)
+	})
+}
+
+// Remove appends a record removing the snapshot file with the given name
+func (kv KVFile) Remove(name string) error {
+	return kv.update(func(f *os.File, end int64) error {
+		records, _, err := scanKV(f)
+		if err != nil {
+			return err
+		}
+		if _, ok := records[name]; !ok {
+			return nil
+		}
+		return appendKV(f, end, kvDelete, name, bytes.NewReader(nil))
+	})
+}
+
+// Stat returns the size and modification time of the snapshot file with the given name
+func (kv KVFile) Stat(name string) (int64, time.Time, error) {
+	unlock, err := kv.lock(syscall.LOCK_SH)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer unlock()
+
+	f, err := os.Open(string(kv))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer f.Close()
+
+	records, _, err := scanKV(f)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	r, ok := records[name]
+	if !ok {
+		return 0, time.Time{}, kv.notExist(name)
+	}
+	return r.size, r.modTime, nil
+}
+
+func (kv KVFile) notExist(name string) error {
+	return &os.PathError{Op: "open", Path: string(kv) + "#" + name, Err: os.ErrNotExist}
+}
+
+// lock locks the lock file with the given flock operation, and returns the function which unlocks it
+func (kv KVFile) lock(how int) (func(), error) {
+	lock, err := os.OpenFile(string(kv)+kvLockSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), how); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("could not lock %s: %v", string(kv), err)
+	}
+	return func() { lock.Close() }, nil
+}
+
+// update calls write with the file locked for writing and the offset after its last complete record, discarding any
+// incomplete record after it, and compacts the file afterwards if needed
+func (kv KVFile) update(write func(f *os.File, end int64) error) error {
+	unlock, err := kv.lock(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(string(kv), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, end, err := scanKV(f)
+	if err != nil {
+		return err
+	}
+	if end == 0 {
+		if _, err := f.WriteAt(kvMagic, 0); err != nil {
+			return fmt.Errorf("could not write %s: %v", string(kv), err)
+		}
+		end = int64(len(kvMagic))
+	}
+	if err := f.Truncate(end); err != nil {
+		return fmt.Errorf("could not write %s: %v", string(kv), err)
+	}
+
+	if err := write(f, end); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("could not sync %s: %v", string(kv), err)
+	}
+	return kv.compact(f)
+}
+
+// compact rewrites the file with only its current records if most of it is overwritten or removed records
+func (kv KVFile) compact(f *os.File) error {
+	records, end, err := scanKV(f)
+	if err != nil {
+		return err
+	}
+	live := int64(len(kvMagic))
+	var sorted []kvRecord
+	for _, r := range records {
+		live += r.end - r.offset
+		sorted = append(sorted, r)
+	}
+	if end < kvCompactSize || end < 2*live {
+		return nil
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].offset < sorted[j].offset })
+
+	dir := filepath.Dir(string(kv))
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(string(kv))+".")
+	if err != nil {
+		return fmt.Errorf("could not compact %s: %v", string(kv), err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	_, err = tmp.Write(kvMagic)
+	for _, r := range sorted {
+		if err != nil {
+			break
+		}
+		_, err = io.Copy(tmp, io.NewSectionReader(f, r.offset, r.end-r.offset))
+	}
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), string(kv))
+	}
+	if err != nil {
+		return fmt.Errorf("could not compact %s: %v", string(kv), err)
+	}
+	return syncDir(dir)
+}
+
+// appendKV writes a record at the given offset. The value length is only known once the value is written, so it is
+// written afterwards in the header, and the checksum covers the value followed by the complete header.
+func appendKV(f *os.File, offset int64, op byte, name string, r io.Reader) error {
+	h := make([]byte, kvHeaderSize+len(name))
+	h[0] = op
+	binary.BigEndian.PutUint16(h[1:], uint16(len(name)))
+	copy(h[3:], name)
+	binary.BigEndian.PutUint64(h[3+len(name):], uint64(time.Now().UnixNano()))
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	w := bufio.NewWriter(f)
+	sum := crc32.NewIEEE()
+	if _, err := w.Write(h); err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	size, err := io.Copy(io.MultiWriter(w, sum), r)
+	if err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	binary.BigEndian.PutUint64(h[len(h)-8:], uint64(size))
+	_, _ = sum.Write(h)
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], sum.Sum32())
+	if _, err := w.Write(checksum[:]); err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	if _, err := f.WriteAt(h[len(h)-8:], offset+int64(len(h)-8)); err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	return nil
+}
+
+// Statuses of a record read by readKV
+const (
+	kvValid = iota
+	// kvCorrupted is a record which ends within the file but does not match its checksum
+	kvCorrupted
+	// kvIncomplete is a record which would end past the end of the file
+	kvIncomplete
+)
+
+// scanKV reads the records in a key-value file, and returns the current record of every key and the offset after the
+// last complete record. A record which does not match its checksum is skipped, and the file is scanned for the next
+// valid record after it, so it does not hide the newer ones. It is kept as the current record of its key if it ends
+// where the next one starts, so reading it fails instead of returning an older value. Only bad data after the last
+// valid record, which is what a write interrupted by a crash leaves, is left out of the returned offset.
+func scanKV(f *os.File) (map[string]kvRecord, int64, error) {
+	records := make(map[string]kvRecord)
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	size := fi.Size()
+	if size == 0 {
+		return records, 0, nil
+	}
+	m := make([]byte, len(kvMagic))
+	if _, err := f.ReadAt(m, 0); err != nil || !bytes.Equal(m, kvMagic) {
+		return nil, 0, fmt.Errorf("%s is not a key-value snapshot file", f.Name())
+	}
+
+	offset := int64(len(kvMagic))
+	for offset < size {
+		r, status, err := readKV(f, offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if status == kvValid {
+			switch r.op {
+			case kvPut:
+				records[r.name] = r
+			case kvDelete:
+				delete(records, r.name)
+			}
+			offset = r.end
+			continue
+		}
+
+		next, err := resyncKV(f, offset+1, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if next < 0 {
+			next = size
+			if status == kvIncomplete || r.end != size {
+				return records, offset, nil
+			}
+		}
+		if status == kvCorrupted && r.end == next {
+			r.corrupted = true
+			records[r.name] = r
+		}
+		offset = next
+	}
+	return records, offset, nil
+}
+
+// readKV reads the record at the given offset of a key-value file of the given size
+func readKV(f io.ReaderAt, offset, size int64) (kvRecord, int, error) {
+	readAt := func(b []byte, off int64) (bool, error) {
+		_, err := f.ReadAt(b, off)
+		if err == io.EOF {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	fixed := make([]byte, 3)
+	if ok, err := readAt(fixed, offset); !ok {
+		return kvRecord{}, kvIncomplete, err
+	}
+	h := make([]byte, kvHeaderSize+int(binary.BigEndian.Uint16(fixed[1:])))
+	if ok, err := readAt(h, offset); !ok {
+		return kvRecord{}, kvIncomplete, err
+	}
+	value := offset + int64(len(h))
+	valueSize := int64(binary.BigEndian.Uint64(h[len(h)-8:]))
+	if valueSize < 0 || valueSize > size-value-4 {
+		return kvRecord{}, kvIncomplete, nil
+	}
+	r := kvRecord{
+		name:    string(h[3 : len(h)-16]),
+		op:      h[0],
+		offset:  offset,
+		end:     value + valueSize + 4,
+		value:   value,
+		size:    valueSize,
+		modTime: time.Unix(0, int64(binary.BigEndian.Uint64(h[len(h)-16:]))),
+	}
+
+	sum := crc32.NewIEEE()
+	if _, err := io.Copy(sum, io.NewSectionReader(f, value, valueSize)); err != nil {
+		return kvRecord{}, 0, err
+	}
+	_, _ = sum.Write(h)
+	var checksum [4]byte
+	if ok, err := readAt(checksum[:], r.end-4); !ok {
+		return kvRecord{}, kvIncomplete, err
+	}
+	if binary.BigEndian.Uint32(checksum[:]) != sum.Sum32() || r.op > kvDelete {
+		return r, kvCorrupted, nil
+	}
+	return r, kvValid, nil
+}
+
+// resyncKV returns the offset of the first valid record from the given offset of a key-value file of the given size,
+// or -1 if there is none
+func resyncKV(f io.ReaderAt, from, size int64) (int64, error) {
+	buf := make([]byte, 64<<10)
+	for start := from; start < size; start += int64(len(buf)) {
+		n, err := f.ReadAt(buf, start)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := range buf[:n] {
+			if !plausibleKV(buf[i:n], start+int64(i), size) {
+				continue
+			}
+			_, status, err := readKV(f, start+int64(i), size)
+			if err != nil {
+				return 0, err
+			}
+			if status == kvValid {
+				return start + int64(i), nil
+			}
+		}
+	}
+	return -1, nil
+}
+
+// plausibleKV returns whether a record can start at the given offset of a key-value file of the given size, where b
+// is read from that offset. Most offsets are ruled out by the bytes in b, without reading the file again.
+func plausibleKV(b []byte, offset, size int64) bool {
+	if len(b) > 0 && b[0] > kvDelete {
+		return false
+	}
+	if len(b) < 3 {
+		return true
+	}
+	h := kvHeaderSize + int(binary.BigEndian.Uint16(b[1:]))
+	if len(b) < h {
+		return true
+	}
+	remaining := size - offset - int64(h) - 4
+	valueSize := binary.BigEndian.Uint64(b[h-8 : h])
+	if remaining < 0 || valueSize > uint64(remaining) {
+		return false
+	}
+	end := h + int(valueSize) + 4
+	if len(b) < end {
+		return true
+	}
+	sum := crc32.Update(crc32.ChecksumIEEE(b[h:end-4]), crc32.IEEETable, b[:h])
+	return binary.BigEndian.Uint32(b[end-4:end]) == sum
+}
@@ -0,0 +1,294 @@
+package snapshot
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readStored returns the content of the snapshot file with the given name in the store
+func readStored(t *testing.T, store Store, name string) string {
+	r, err := store.Open(name)
+	if err != nil {
+		t.Fatalf("could not open %s: %v", name, err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("could not read %s: %v", name, err)
+	}
+	return string(b)
+}
+
+func putString(t *testing.T, store Store, name, value string) {
+	if err := store.Put(name, strings.NewReader(value)); err != nil {
+		t.Fatalf("could not put %s: %v", name, err)
+	}
+}
+
+func TestKVFile(t *testing.T) {
+	kv := KVFile(filepath.Join(tempDir(t), "snapshots.kv"))
+
+	if _, err := kv.Open("a"); !os.IsNotExist(err) {
+		t.Errorf("got %v opening a key in a missing file, want a not exist error", err)
+	}
+	putString(t, kv, "a", "first")
+	putString(t, kv, "b", "")
+	putString(t, kv, "a", "second")
+
+	if got := readStored(t, kv, "a"); got != "second" {
+		t.Errorf("read %q, want the overwritten value", got)
+	}
+	if got := readStored(t, kv, "b"); got != "" {
+		t.Errorf("read %q, want an empty value", got)
+	}
+	size, modTime, err := kv.Stat("a")
+	if err != nil || size != int64(len("second")) || modTime.IsZero() {
+		t.Errorf("got %d, %v, %v, want the size and modification time of the value", size, modTime, err)
+	}
+
+	if err := kv.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Remove("missing"); err != nil {
+		t.Errorf("got %v removing a missing key", err)
+	}
+	if _, err := kv.Open("a"); !os.IsNotExist(err) {
+		t.Errorf("got %v opening a removed key, want a not exist error", err)
+	}
+	if _, _, err := kv.Stat("a"); !os.IsNotExist(err) {
+		t.Errorf("got %v getting the size of a removed key, want a not exist error", err)
+	}
+}
+
+func TestKVFileTruncatedRecord(t *testing.T) {
+	path := filepath.Join(tempDir(t), "snapshots.kv")
+	kv := KVFile(path)
+	putString(t, kv, "a", "complete")
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete := fi.Size()
+	putString(t, kv, "b", strings.Repeat("b", 100))
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for cut := complete + 1; cut < int64(len(b)); cut++ {
+		if err := ioutil.WriteFile(path, b[:cut], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := readStored(t, kv, "a"); got != "complete" {
+			t.Fatalf("read %q with the last record cut at %d", got, cut)
+		}
+		if _, err := kv.Open("b"); !os.IsNotExist(err) {
+			t.Fatalf("got %v opening a record cut at %d, want a not exist error", err, cut)
+		}
+	}
+
+	// The next record overwrites the incomplete one
+	putString(t, kv, "c", "after")
+	if got := readStored(t, kv, "c"); got != "after" {
+		t.Errorf("read %q after an incomplete record", got)
+	}
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after[:complete], b[:complete]) || bytes.Contains(after, []byte("bbb")) {
+		t.Error("the incomplete record was not discarded")
+	}
+}
+
+func TestKVFileCorruptedRecord(t *testing.T) {
+	path := filepath.Join(tempDir(t), "snapshots.kv")
+	kv := KVFile(path)
+	putString(t, kv, "a", "oldest")
+	putString(t, kv, "b", "previous")
+	putString(t, kv, "a", "overwritten")
+	putString(t, kv, "c", "newest")
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt(t, path, bytes.Index(b, []byte("overwritten")))
+
+	// The corrupted record is not replaced by the older one of its key, and does not hide the newer ones
+	if _, err := kv.Open("a"); err == nil || os.IsNotExist(err) {
+		t.Errorf("got %v opening a corrupted record, want an error", err)
+	}
+	putString(t, kv, "d", "appended")
+	for name, want := range map[string]string{"b": "previous", "c": "newest", "d": "appended"} {
+		if got := readStored(t, kv, name); got != want {
+			t.Errorf("read %q from %s after a corrupted record, want %q", got, name, want)
+		}
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() <= fi.Size() {
+		t.Errorf("file shrank from %d to %d bytes after a corrupted record", fi.Size(), after.Size())
+	}
+
+	// A new record replaces the corrupted one
+	putString(t, kv, "a", "replaced")
+	if got := readStored(t, kv, "a"); got != "replaced" {
+		t.Errorf("read %q after replacing a corrupted record", got)
+	}
+}
+
+func TestKVFileCorruptedLength(t *testing.T) {
+	path := filepath.Join(tempDir(t), "snapshots.kv")
+	kv := KVFile(path)
+	putString(t, kv, "a", "first")
+	putString(t, kv, "b", "second")
+	putString(t, kv, "c", "third")
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The value length of the record of b, which ends its header
+	corrupt(t, path, bytes.Index(b, []byte("second"))-2)
+
+	if _, err := kv.Open("b"); !os.IsNotExist(err) {
+		t.Errorf("got %v opening a record with a corrupted length, want a not exist error", err)
+	}
+	putString(t, kv, "d", "fourth")
+	for name, want := range map[string]string{"a": "first", "c": "third", "d": "fourth"} {
+		if got := readStored(t, kv, name); got != want {
+			t.Errorf("read %q from %s after a record with a corrupted length, want %q", got, name, want)
+		}
+	}
+}
+
+func TestKVFileInterruptedRecord(t *testing.T) {
+	path := filepath.Join(tempDir(t), "snapshots.kv")
+	kv := KVFile(path)
+	putString(t, kv, "a", "complete")
+	putString(t, kv, "b", strings.Repeat("b", 100))
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A crash before the value length is written leaves it zero
+	start := bytes.Index(b, []byte("bbb"))
+	if err := ioutil.WriteFile(path, append(b[:start-8], append(make([]byte, 8), b[start:]...)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kv.Open("b"); !os.IsNotExist(err) {
+		t.Errorf("got %v opening an interrupted record, want a not exist error", err)
+	}
+	putString(t, kv, "c", "after")
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(after, []byte("bbb")) {
+		t.Error("the interrupted record was not discarded")
+	}
+	if got := readStored(t, kv, "a"); got != "complete" {
+		t.Errorf("read %q after an interrupted record", got)
+	}
+}
+
+func TestKVFileCompaction(t *testing.T) {
+	path := filepath.Join(tempDir(t), "snapshots.kv")
+	kv := KVFile(path)
+	putString(t, kv, "kept", "kept value")
+
+	value := strings.Repeat("x", 100<<10)
+	var max int64
+	for i := 0; i < 50; i++ {
+		putString(t, kv, "overwritten", value+string(rune('a'+i%26)))
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > max {
+			max = fi.Size()
+		}
+	}
+
+	// The file is compacted once it reaches kvCompactSize, so it never grows much beyond it
+	if max > kvCompactSize+int64(len(value))*2 {
+		t.Errorf("file grew to %d bytes, want it compacted", max)
+	}
+	if got := readStored(t, kv, "overwritten"); got != value+"x" {
+		t.Errorf("read a value of %d bytes ending in %q after compacting", len(got), got[len(got)-1:])
+	}
+	if got := readStored(t, kv, "kept"); got != "kept value" {
+		t.Errorf("read %q, want the value kept by compacting", got)
+	}
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(path), ".snapshots.kv.*"))
+	if err != nil || len(matches) > 0 {
+		t.Errorf("compacting left temporary files %v", matches)
+	}
+}
+
+func TestKVFileNotKV(t *testing.T) {
+	path := filepath.Join(tempDir(t), "snapshots.kv")
+	if err := ioutil.WriteFile(path, []byte("not a key-value file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	kv := KVFile(path)
+
+	if _, err := kv.Open("a"); err == nil || os.IsNotExist(err) {
+		t.Errorf("got %v opening a file which is not a key-value file", err)
+	}
+	if err := kv.Put("a", strings.NewReader("value")); err == nil {
+		t.Error("wrote to a file which is not a key-value file")
+	}
+}
+
+func TestKVFileSnapshots(t *testing.T) {
+	path := filepath.Join(tempDir(t), "snapshots.kv")
+	files := Files{Location: "kv:" + path + "#data", Keep: 2}
+	saveAll(t, files, testData{N: 1}, testData{N: 2}, testData{N: 3})
+
+	store, _, err := files.store()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Open("data" + stagedSuffix); !os.IsNotExist(err) {
+		t.Errorf("got %v opening the staged snapshot, want it removed", err)
+	}
+	if _, err := store.Open("data.2"); !os.IsNotExist(err) {
+		t.Errorf("got %v opening a snapshot older than the kept ones", err)
+	}
+
+	var loaded testData
+	if err := files.Load(&loaded); err != nil || loaded.N != 3 {
+		t.Errorf("loaded %v, %v, want the newest snapshot", loaded, err)
+	}
+	// A corrupted record falls back to the previous snapshot
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, _, err := scanKV(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt(t, path, int(records["data"].value)+len(magic)+1)
+	if err := files.Load(&loaded); err != nil || loaded.N != 2 {
+		t.Errorf("loaded %v, %v with a corrupted newest record, want the previous snapshot", loaded, err)
+	}
+	if err := store.Remove("data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := files.Load(&loaded); err != nil || loaded.N != 2 {
+		t.Errorf("loaded %v, %v, want the previous snapshot", loaded, err)
+	}
+}
@@ -0,0 +1,255 @@
+package snapshot
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultS3Region = "us-east-1"
+	s3Service       = "s3"
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	s3TimeFormat    = "20060102T150405Z"
+)
+
+// S3 stores snapshot files as objects in a bucket of an S3 compatible service, such as Amazon S3 or MinIO. Requests
+// are signed with AWS Signature Version 4 and use path-style URLs, so any endpoint can be used, such as a local
+// server for testing.
+//
+// In a location, the endpoint and region are given as the "endpoint" and "region" query parameters. The credentials
+// are read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables if they are
+// not set, so they are never recorded in locations.
+type S3 struct {
+	// Endpoint is the base URL of the service, https://s3.<region>.amazonaws.com by default
+	Endpoint string
+	// Region is the region requests are signed for, AWS_REGION or us-east-1 by default
+	Region string
+	Bucket string
+	// Prefix is prepended to the snapshot names to get the object keys, usually ending in a slash
+	Prefix string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Client makes the requests, http.DefaultClient by default
+	Client *http.Client
+}
+
+// Open gets the object of the snapshot file with the given name
+func (s *S3) Open(name string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, name, payload{})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Put uploads the object of the snapshot file with the given name. Objects are replaced atomically, but their size
+// and checksum must be known to sign the request, so the file is spooled to a temporary file first, keeping the
+// memory used bounded whatever its size.
+func (s *S3) Put(name string, r io.Reader) error {
+	tmp, err := ioutil.TempFile("", "snapshot-s3-")
+	if err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	defer tmp.Close()
+
+	sum := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, sum), r)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	resp, err := s.do(http.MethodPut, name, payload{r: tmp, size: size, sum: sum.Sum(nil)})
+	if err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	return resp.Body.Close()
+}
+
+// Remove deletes the object of the snapshot file with the given name
+func (s *S3) Remove(name string) error {
+	resp, err := s.do(http.MethodDelete, name, payload{})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Stat returns the size and modification time of the object of the snapshot file with the given name
+func (s *S3) Stat(name string) (int64, time.Time, error) {
+	resp, err := s.do(http.MethodHead, name, payload{})
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.ContentLength, modTime, nil
+}
+
+// payload is the body of a request, with its size and SHA-256 checksum, or no body if r is nil
+type payload struct {
+	r    io.Reader
+	size int64
+	sum  []byte
+}
+
+// do sends a signed request for the object of the snapshot file with the given name, and returns the response if it
+// succeeded. It returns an error satisfying os.IsNotExist if the object does not exist.
+func (s *S3) do(method, name string, body payload) (*http.Response, error) {
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + s.region() + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %s: %v", endpoint, err)
+	}
+	key := s.Prefix + name
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.Bucket + "/" + key
+	u.RawPath = s3Escape(u.Path)
+
+	if body.r == nil {
+		empty := sha256.Sum256(nil)
+		body = payload{r: bytes.NewReader(nil), sum: empty[:]}
+	}
+	req, err := http.NewRequest(method, u.String(), ioutil.NopCloser(body.r))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = body.size
+	if body.size == 0 {
+		req.Body = http.NoBody
+	}
+	if err := s.sign(req, body.sum, time.Now()); err != nil {
+		return nil, err
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		path := "s3://" + s.Bucket + "/" + key
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: path, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %s s3://%s/%s failed with %s: %s", method, s.Bucket, key, resp.Status,
+			strings.TrimSpace(string(b)))
+	}
+	return resp, nil
+}
+
+func (s *S3) region() string {
+	if s.Region != "" {
+		return s.Region
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return defaultS3Region
+}
+
+// sign adds the AWS Signature Version 4 authorization headers to the request, whose body has the given SHA-256
+// checksum
+func (s *S3) sign(req *http.Request, payloadHash []byte, now time.Time) error {
+	accessKeyID, secretAccessKey, sessionToken := s.AccessKeyID, s.SecretAccessKey, s.SessionToken
+	if accessKeyID == "" {
+		accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if accessKeyID == "" || secretAccessKey == "" {
+		return fmt.Errorf("missing S3 credentials, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash))
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if sessionToken != "" {
+		signed = append(signed, "x-amz-security-token")
+	}
+	var canonicalHeaders strings.Builder
+	for _, name := range signed {
+		value := req.URL.Host
+		if name != "host" {
+			value = req.Header.Get(name)
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + s.region() + "/" + s3Service + "/aws4_request"
+	stringToSign := strings.Join([]string{s3Algorithm, now.Format(s3TimeFormat), scope,
+		hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	for _, part := range []string{s.region(), s3Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, accessKeyID, scope, signedHeaders, signature))
+	return nil
+}
+
+// s3Escape escapes an object key for a URL path as S3 expects in signatures, escaping everything but unreserved
+// characters and slashes
+func s3Escape(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,196 @@
+package snapshot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var s3Authorization = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/\d{8}/eu-west-1/s3/aws4_request, ` +
+	`SignedHeaders=host;x-amz-content-sha256;x-amz-date(;x-amz-security-token)?, Signature=[0-9a-f]{64}$`)
+
+// s3Bucket is an in-memory S3 bucket which checks the shape of the signature of every request
+type s3Bucket struct {
+	t       *testing.T
+	mu      sync.Mutex
+	objects map[string][]byte
+	// requests records the method and path of every request
+	requests []string
+}
+
+func newS3(t *testing.T) (*S3, *s3Bucket) {
+	bucket := &s3Bucket{t: t, objects: map[string][]byte{}}
+	server := httptest.NewServer(bucket)
+	t.Cleanup(server.Close)
+	return &S3{
+		Endpoint:        server.URL,
+		Region:          "eu-west-1",
+		Bucket:          "bucket",
+		Prefix:          "app/",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}, bucket
+}
+
+func (b *s3Bucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		b.t.Errorf("could not read request body: %v", err)
+	}
+	if r.ContentLength != int64(len(body)) {
+		b.t.Errorf("%s %s: got content length %d for %d bytes", r.Method, r.URL.Path, r.ContentLength, len(body))
+	}
+	hash := sha256.Sum256(body)
+	if got := r.Header.Get("X-Amz-Content-Sha256"); got != hex.EncodeToString(hash[:]) {
+		b.t.Errorf("%s %s: got content hash %q, want the hash of the body", r.Method, r.URL.Path, got)
+	}
+	if _, err := time.Parse(s3TimeFormat, r.Header.Get("X-Amz-Date")); err != nil {
+		b.t.Errorf("%s %s: invalid date: %v", r.Method, r.URL.Path, err)
+	}
+	if auth := r.Header.Get("Authorization"); !s3Authorization.MatchString(auth) {
+		b.t.Errorf("%s %s: invalid authorization %q", r.Method, r.URL.Path, auth)
+	}
+	if r.Header.Get("X-Amz-Security-Token") == "expired" {
+		http.Error(w, "<Error><Code>ExpiredToken</Code></Error>", http.StatusForbidden)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requests = append(b.requests, r.Method+" "+r.URL.EscapedPath())
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	object, ok := b.objects[key]
+	switch r.Method {
+	case http.MethodPut:
+		b.objects[key] = body
+	case http.MethodDelete:
+		delete(b.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(object)))
+		_, _ = w.Write(object)
+	}
+}
+
+func TestS3(t *testing.T) {
+	s3, bucket := newS3(t)
+
+	if _, err := s3.Open("data"); !os.IsNotExist(err) {
+		t.Errorf("got %v opening a missing object, want a not exist error", err)
+	}
+	if _, _, err := s3.Stat("data"); !os.IsNotExist(err) {
+		t.Errorf("got %v getting the size of a missing object, want a not exist error", err)
+	}
+
+	putString(t, s3, "data file", "value")
+	if got := readStored(t, s3, "data file"); got != "value" {
+		t.Errorf("read %q", got)
+	}
+	size, modTime, err := s3.Stat("data file")
+	if err != nil || size != int64(len("value")) || modTime.IsZero() {
+		t.Errorf("got %d, %v, %v, want the size and modification time of the object", size, modTime, err)
+	}
+
+	if err := s3.Remove("data file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3.Open("data file"); !os.IsNotExist(err) {
+		t.Errorf("got %v opening a removed object, want a not exist error", err)
+	}
+
+	want := []string{
+		"GET /bucket/app/data",
+		"HEAD /bucket/app/data",
+		"PUT /bucket/app/data%20file",
+		"GET /bucket/app/data%20file",
+		"HEAD /bucket/app/data%20file",
+		"DELETE /bucket/app/data%20file",
+		"GET /bucket/app/data%20file",
+	}
+	if strings.Join(bucket.requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("sent requests\n%s\nwant\n%s", strings.Join(bucket.requests, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestS3Errors(t *testing.T) {
+	s3, _ := newS3(t)
+	s3.SessionToken = "expired"
+
+	err := s3.Put("data", strings.NewReader("value"))
+	if err == nil || os.IsNotExist(err) || !strings.Contains(err.Error(), "ExpiredToken") {
+		t.Errorf("got %v with an expired token, want the error returned by S3", err)
+	}
+
+	s3.AccessKeyID = ""
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	if _, err := s3.Open("data"); err == nil || !strings.Contains(err.Error(), "missing S3 credentials") {
+		t.Errorf("got %v without credentials", err)
+	}
+}
+
+func TestS3Sign(t *testing.T) {
+	s3 := &S3{
+		Region:          "eu-west-1",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		SessionToken:    "token",
+	}
+	body := []byte("snapshot")
+	req, err := http.NewRequest(http.MethodPut, "https://s3.example.com/bucket/app/data%20file.1", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(body)
+	if err := s3.sign(req, sum[:], time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"Authorization": "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20200102/eu-west-1/s3/aws4_request, " +
+			"SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token, " +
+			"Signature=a425ff30f200e4739f776a04b8f872a8c909890dfa118b03e03af21e797d732a",
+		"X-Amz-Content-Sha256": "16a0eeb0791b6c92451fd284dd9f599e0a7dbe7f6ebea6e2d2d06c7f74aec112",
+		"X-Amz-Date":           "20200102T030405Z",
+		"X-Amz-Security-Token": "token",
+	}
+	for name, value := range want {
+		if got := req.Header.Get(name); got != value {
+			t.Errorf("got %s %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestS3Snapshots(t *testing.T) {
+	s3, bucket := newS3(t)
+	files := Files{Location: "data", Keep: 2, Store: s3}
+	saveAll(t, files, testData{N: 1}, testData{N: 2}, testData{N: 3})
+
+	var loaded testData
+	if err := files.Load(&loaded); err != nil || loaded.N != 3 {
+		t.Errorf("loaded %v, %v, want the newest snapshot", loaded, err)
+	}
+	bucket.mu.Lock()
+	var keys []string
+	for key := range bucket.objects {
+		keys = append(keys, key)
+	}
+	bucket.mu.Unlock()
+	if len(keys) != 2 {
+		t.Errorf("bucket has objects %q, want the kept snapshots only", keys)
+	}
+}
@@ -0,0 +1,85 @@
+package snapshot
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Schema is the version of the values saved in snapshots, and how to migrate the values of older versions to it
+type Schema struct {
+	// Version is the current version, recorded in new snapshots. Snapshots written before versions were recorded are
+	// version 1.
+	Version    int
+	migrations map[int]migration
+}
+
+type migration struct {
+	old     func() interface{}
+	migrate func(old interface{}) (interface{}, error)
+}
+
+// SchemaError is returned when a snapshot can not be migrated to the current schema version
+type SchemaError struct {
+	From, To int
+}
+
+func (e *SchemaError) Error() string {
+	if e.From > e.To {
+		return fmt.Sprintf("snapshot schema version %d is newer than the supported version %d", e.From, e.To)
+	}
+	return fmt.Sprintf("no migration path from snapshot schema version %d to %d", e.From, e.To)
+}
+
+// Migrate registers the migration from the given version to the next one. Old returns a pointer to decode snapshots
+// of that version into, and migrate converts the value of that version, as returned by old or by the migration from
+// the previous version, to the value of the next version.
+func (s *Schema) Migrate(from int, old func() interface{}, migrate func(old interface{}) (interface{}, error)) {
+	if s.migrations == nil {
+		s.migrations = make(map[int]migration)
+	}
+	s.migrations[from] = migration{old: old, migrate: migrate}
+}
+
+func (s *Schema) version() int {
+	if s == nil || s.Version == 0 {
+		return 1
+	}
+	return s.Version
+}
+
+// upgrade decodes a snapshot of the given version with the given function and migrates it to the current version,
+// storing it in v
+func (s *Schema) upgrade(from int, decode func(v interface{}) error, v interface{}) error {
+	to := s.version()
+	if s == nil || from > to {
+		return &SchemaError{From: from, To: to}
+	}
+	for version := from; version < to; version++ {
+		if _, ok := s.migrations[version]; !ok {
+			return &SchemaError{From: from, To: to}
+		}
+	}
+
+	value := s.migrations[from].old()
+	if err := decode(value); err != nil {
+		return err
+	}
+	for version := from; version < to; version++ {
+		var err error
+		value, err = s.migrations[version].migrate(value)
+		if err != nil {
+			return fmt.Errorf("could not migrate snapshot from schema version %d to %d: %v", version, version+1, err)
+		}
+	}
+
+	target := reflect.ValueOf(v).Elem()
+	migrated := reflect.ValueOf(value)
+	if migrated.Type() != target.Type() && migrated.Kind() == reflect.Ptr {
+		migrated = migrated.Elem()
+	}
+	if migrated.Type() != target.Type() {
+		return fmt.Errorf("migration to schema version %d returned %s instead of %s", to, migrated.Type(), target.Type())
+	}
+	target.Set(migrated)
+	return nil
+}
@@ -0,0 +1,469 @@
+// Package snapshot stores application snapshots in files which are written atomically and checksummed, keeping the
+// previous ones so a corrupted snapshot can fall back to an older one instead of losing the state. Snapshot files are
+// kept in a Store, such as a directory, a key-value file or an S3 bucket.
+//
+// A snapshot file starts with a magic number including the format version, followed by a header with the name of the
+// codec, the schema version of the value, the ID of the key it is encrypted with and the name of its compression if
+// any. The encoded value follows, compressed and split in checksummed chunks, each one sealed with AES-GCM if
+// encrypted, and the file ends with the SHA-256 checksum of everything after the magic number. Snapshots are written
+// and read as streams, one chunk at a time. A file without the magic number is read as a gob encoded value of schema
+// version 1, as written before snapshot files had a format, as long as nothing follows the value and no keys are
+// configured.
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+)
+
+const (
+	defaultKeep = 3
+	// stagedSuffix is appended to the name of the newest snapshot to get the name a new snapshot is written to before
+	// the snapshots are rotated
+	stagedSuffix = ".new"
+)
+
+// formatVersion is the version of the snapshot file format, recorded in the magic number
+const formatVersion = 1
+
+var magic = []byte("GRSNAP\x00\x01")
+
+// ErrNoSnapshot is returned when loading if there is no snapshot at all
+var ErrNoSnapshot = errors.New("no snapshot")
+
+// Files are the snapshot files at a location. The newest snapshot has the name at the location and the previous ones
+// have that name followed by their age, such as "data.gob.1" for the one before the newest.
+type Files struct {
+	// Location is where the newest snapshot is, as parsed by ParseLocation, or its name in the Store if set
+	Location string
+	// Store is where the snapshots are stored, or nil to use the store at the Location
+	Store Store
+	// Keep is how many snapshots are kept including the newest one, 3 by default
+	Keep int
+	// Codec encodes new snapshots, Gob by default. Snapshots are decoded with the codec they were encoded with.
+	Codec Codec
+	// Schema is the schema version of the snapshots and its migrations, or nil if it is always version 1
+	Schema *Schema
+	// Keys encrypt new snapshots with the current key and decrypt the encrypted ones, or nil to write them in the
+	// clear. Snapshots written in the clear can always be read.
+	Keys *Keys
+	// Compression compresses new snapshots, or nil to write them uncompressed. Snapshots are decompressed with the
+	// compression they were written with.
+	Compression Compression
+	// ChunkSize is the size of the chunks new snapshots are split in, DefaultChunkSize by default. Snapshots are
+	// written and read one chunk at a time, so the memory they take is bounded by it whatever the size of the state.
+	ChunkSize int
+}
+
+// header is the metadata recorded in a snapshot file before the value
+type header struct {
+	codec   Codec
+	version int
+	// keyID is the ID of the key the value is encrypted with, or empty if it is not encrypted
+	keyID string
+	// compression is the compression of the value, or nil if it is not compressed
+	compression Compression
+	// format and raw are only set when reading. Format is 0 for a file written before snapshot files had a format,
+	// and raw is the magic number followed by the encoded header, which is authenticated along with the encrypted
+	// value.
+	format int
+	raw    []byte
+}
+
+// Validator is implemented by values which can check that they are valid after being decoded from a snapshot
+type Validator interface {
+	Validate() error
+}
+
+func (f Files) keep() int {
+	if f.Keep <= 0 {
+		return defaultKeep
+	}
+	return f.Keep
+}
+
+// store returns the store and the name of the newest snapshot in it
+func (f Files) store() (Store, string, error) {
+	if f.Store != nil {
+		return f.Store, f.Location, nil
+	}
+	return ParseLocation(f.Location)
+}
+
+// agedName returns the name of the snapshot of the given age, 0 being the newest one
+func agedName(newest string, age int) string {
+	if age == 0 {
+		return newest
+	}
+	return fmt.Sprintf("%s.%d", newest, age)
+}
+
+// Save writes a new snapshot of the given value with its checksum. The snapshot is written in full before rotating
+// the previous ones, so they are all kept if it fails, and then it atomically replaces the newest snapshot, so it is
+// always complete, and the oldest one is discarded. The snapshot is encoded while it is written to the store, so it
+// is never held in memory as a whole unless the store needs to.
+func (f Files) Save(v interface{}) error {
+	codec := f.Codec
+	if codec == nil {
+		codec = Gob
+	}
+	store, newest, err := f.store()
+	if err != nil {
+		return err
+	}
+
+	h := header{codec: codec, version: f.Schema.version(), compression: f.Compression}
+	if f.Keys != nil {
+		h.keyID = f.Keys.Current
+	}
+
+	staged := newest + stagedSuffix
+	if err := f.put(store, staged, h, v); err != nil {
+		_ = store.Remove(staged)
+		return err
+	}
+	return f.rotate(store, newest, staged)
+}
+
+// put writes the snapshot of the given value to the store with the given name
+func (f Files) put(store Store, name string, h header, v interface{}) error {
+	r, w := io.Pipe()
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		_ = w.CloseWithError(f.writeSnapshot(w, h, v))
+	}()
+	err := store.Put(name, r)
+	// Stop the encoding if the store failed before reading all of it
+	_ = r.Close()
+	<-written
+	return err
+}
+
+// writeSnapshot writes the snapshot file of the given value, compressing and encrypting it one chunk at a time
+func (f Files) writeSnapshot(w io.Writer, h header, v interface{}) error {
+	encoded := encodeHeader(h)
+	var aead cipher.AEAD
+	if h.keyID != "" {
+		var err error
+		if aead, err = f.Keys.aead(h.keyID); err != nil {
+			return err
+		}
+	}
+
+	sum := sha256.New()
+	if _, err := w.Write(magic); err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	hashed := io.MultiWriter(w, sum)
+	if _, err := hashed.Write(encoded); err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+
+	chunks := newChunkWriter(hashed, aead, append(append([]byte{}, magic...), encoded...), f.ChunkSize)
+	payload := io.WriteCloser(chunks)
+	if h.compression != nil {
+		var err error
+		if payload, err = h.compression.NewWriter(chunks); err != nil {
+			return fmt.Errorf("could not compress snapshot: %v", err)
+		}
+	}
+	if err := h.codec.Encode(payload, v); err != nil {
+		return fmt.Errorf("could not encode snapshot: %v", err)
+	}
+	if h.compression != nil {
+		if err := payload.Close(); err != nil {
+			return fmt.Errorf("could not compress snapshot: %v", err)
+		}
+	}
+	if err := chunks.Close(); err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+
+	if _, err := w.Write(sum.Sum(nil)); err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	return nil
+}
+
+// encodeHeader returns the encoded header, made of the codec name, the schema version, the key ID and the compression
+// name, where names are prefixed by their length
+func encodeHeader(h header) []byte {
+	name := h.codec.Name()
+	encoded := append([]byte{byte(len(name))}, name...)
+	var version [binary.MaxVarintLen64]byte
+	encoded = append(encoded, version[:binary.PutUvarint(version[:], uint64(h.version))]...)
+	encoded = append(append(encoded, byte(len(h.keyID))), h.keyID...)
+	compression := ""
+	if h.compression != nil {
+		compression = h.compression.Name()
+	}
+	return append(append(encoded, byte(len(compression))), compression...)
+}
+
+// rotate makes every snapshot one older, discarding the oldest one, and makes the staged snapshot the newest one.
+// Snapshots are renamed, and the newest one hard linked, if the store is a Renamer, and copied otherwise, so there is
+// always a snapshot with the newest name.
+func (f Files) rotate(store Store, newest, staged string) error {
+	renamer, ok := store.(Renamer)
+	if !ok {
+		return f.rotateCopies(store, newest, staged)
+	}
+
+	for age := f.keep() - 1; age > 1; age-- {
+		if err := renamer.Rename(agedName(newest, age-1), agedName(newest, age)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not rotate snapshots: %v", err)
+		}
+	}
+	if f.keep() > 1 {
+		if err := renamer.Link(newest, agedName(newest, 1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not rotate snapshots: %v", err)
+		}
+	}
+	if err := renamer.Rename(staged, newest); err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	return nil
+}
+
+// rotateCopies rotates the snapshots in a store which can not rename them by copying them
+func (f Files) rotateCopies(store Store, newest, staged string) error {
+	for age := f.keep() - 1; age > 0; age-- {
+		if err := copySnapshot(store, agedName(newest, age-1), agedName(newest, age)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not rotate snapshots: %v", err)
+		}
+	}
+	if err := copySnapshot(store, staged, newest); err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	return store.Remove(staged)
+}
+
+func copySnapshot(store Store, from, to string) error {
+	r, err := store.Open(from)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return store.Put(to, r)
+}
+
+// Load decodes the newest snapshot which verifies into the given pointer, migrating it to the current schema version,
+// and falls back to the previous ones if it is corrupted or can not be decoded. It returns ErrNoSnapshot if there are
+// no snapshots, a *SchemaError or a *KeyError without falling back if the newest one can not be migrated or
+// decrypted, and an error if none of them can be decoded.
+func (f Files) Load(v interface{}) error {
+	store, newest, err := f.store()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for age := 0; age < f.keep(); age++ {
+		name := agedName(newest, age)
+		err := f.read(store, name, v)
+		if os.IsNotExist(err) {
+			continue
+		}
+		found = true
+		if err == nil {
+			if age > 0 {
+				log.Printf("restored previous snapshot %s", name)
+			}
+			return nil
+		}
+		switch err.(type) {
+		case *SchemaError, *KeyError:
+			return err
+		}
+		log.Printf("skipping snapshot %s: %v", name, err)
+	}
+
+	if !found {
+		return ErrNoSnapshot
+	}
+	return fmt.Errorf("no valid snapshot in %s", f.Location)
+}
+
+// Check decodes the newest snapshot into the given pointer like Load, without falling back to the previous ones, to
+// validate it. It returns an error satisfying os.IsNotExist if there is no snapshot.
+func (f Files) Check(v interface{}) error {
+	store, newest, err := f.store()
+	if err != nil {
+		return err
+	}
+	return f.read(store, newest, v)
+}
+
+// read decodes the snapshot with the given name into the given pointer, verifying its checksums and decrypting and
+// decompressing it as it is read, migrates it to the current schema version and validates it if it is a Validator.
+// The value is reset before decoding, so it is not left half decoded from another snapshot, and the whole file is
+// verified before it is considered valid.
+func (f Files) read(store Store, name string, v interface{}) error {
+	h, body, closer, err := openFile(store, name, f.Keys, true)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("can not decode snapshot into non-pointer %T", v)
+	}
+	rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+
+	err = readPayload(h, body, func(payload io.Reader) error {
+		decode := func(v interface{}) error {
+			if err := h.codec.Decode(payload, v); err != nil {
+				return fmt.Errorf("could not decode %s snapshot: %v", h.codec.Name(), err)
+			}
+			return nil
+		}
+		if h.version == f.Schema.version() {
+			return decode(v)
+		}
+		return f.Schema.upgrade(h.version, decode, v)
+	})
+	if err != nil {
+		return err
+	}
+
+	if validator, ok := v.(Validator); ok {
+		return validator.Validate()
+	}
+	return nil
+}
+
+// readPayload calls read with the decompressed payload of a snapshot, and then reads the rest of the file to verify
+// it. A *KeyError from decrypting the file is returned as it is, even if read wrapped it.
+func readPayload(h header, body io.Reader, read func(payload io.Reader) error) error {
+	err := func() error {
+		payload := body
+		if h.compression != nil {
+			decompressed, err := h.compression.NewReader(body)
+			if err != nil {
+				return fmt.Errorf("could not decompress snapshot: %v", err)
+			}
+			defer decompressed.Close()
+			payload = decompressed
+		}
+		if err := read(payload); err != nil {
+			return err
+		}
+		if h.format == 0 {
+			// A headerless gob snapshot has no checksum, so it is only valid if nothing follows the value
+			if n, err := io.Copy(ioutil.Discard, body); err != nil || n > 0 {
+				return fmt.Errorf("unexpected data after headerless gob snapshot")
+			}
+			return nil
+		}
+		if _, err := io.Copy(ioutil.Discard, payload); err != nil {
+			return fmt.Errorf("could not decompress snapshot: %v", err)
+		}
+		_, err := io.Copy(ioutil.Discard, body)
+		return err
+	}()
+
+	if chunks, ok := body.(*chunkReader); ok && err != nil {
+		if keyErr, ok := chunks.err.(*KeyError); ok {
+			return keyErr
+		}
+	}
+	return err
+}
+
+// openFile opens the snapshot file with the given name, and returns its header and a reader of its payload, which
+// verifies the payload as it is read and decrypts it if decrypt is true
+func openFile(store Store, name string, keys *Keys, decrypt bool) (header, io.Reader, io.Closer, error) {
+	f, err := store.Open(name)
+	if err != nil {
+		return header{}, nil, nil, err
+	}
+	h, body, err := readHeader(bufio.NewReader(f), keys, decrypt)
+	if err != nil {
+		f.Close()
+		return header{}, nil, nil, err
+	}
+	return h, body, f, nil
+}
+
+func readHeader(r *bufio.Reader, keys *Keys, decrypt bool) (header, io.Reader, error) {
+	m := make([]byte, len(magic))
+	n, err := io.ReadFull(r, m)
+	if n == 0 {
+		return header{}, nil, fmt.Errorf("not a snapshot file")
+	}
+	if err != nil || !bytes.Equal(m, magic) {
+		// A gob encoded value written before snapshot files had a format, which has no checksum and can not be
+		// encrypted, so it is not trusted once keys are configured. It is read byte by byte, so the gob decoder does
+		// not read past the value and data after it can be detected.
+		if keys != nil && decrypt {
+			return header{}, nil, fmt.Errorf("not a snapshot file, and headerless gob snapshots are not read with keys")
+		}
+		return header{codec: Gob, version: 1}, bufio.NewReader(io.MultiReader(bytes.NewReader(m[:n]), r)), nil
+	}
+
+	raw := append([]byte{}, m...)
+	readName := func() (string, error) {
+		n, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		raw = append(append(raw, n), b...)
+		return string(b), nil
+	}
+	invalid := fmt.Errorf("invalid snapshot header")
+
+	codecName, err := readName()
+	if err != nil {
+		return header{}, nil, invalid
+	}
+	version, err := binary.ReadUvarint(r)
+	if err != nil {
+		return header{}, nil, invalid
+	}
+	var encodedVersion [binary.MaxVarintLen64]byte
+	raw = append(raw, encodedVersion[:binary.PutUvarint(encodedVersion[:], version)]...)
+	keyID, err := readName()
+	if err != nil {
+		return header{}, nil, invalid
+	}
+	compressionName, err := readName()
+	if err != nil {
+		return header{}, nil, invalid
+	}
+
+	h := header{version: int(version), keyID: keyID, format: formatVersion, raw: raw}
+	if h.codec, err = CodecByName(codecName); err != nil {
+		return header{}, nil, err
+	}
+	if compressionName != "" {
+		if h.compression, err = CompressionByName(compressionName); err != nil {
+			return header{}, nil, err
+		}
+	}
+
+	var aead cipher.AEAD
+	if keyID != "" && decrypt {
+		if aead, err = keys.aead(keyID); err != nil {
+			return header{}, nil, err
+		}
+	}
+	sum := sha256.New()
+	_, _ = sum.Write(raw[len(magic):])
+	return h, newChunkReader(r, sum, aead, keyID, raw), nil
+}
@@ -0,0 +1,243 @@
+package snapshot
+
+import (
+	"encoding/gob"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testData struct {
+	N    int
+	Name string
+}
+
+func (d *testData) Validate() error {
+	if d.N < 0 {
+		return errors.New("negative N")
+	}
+	return nil
+}
+
+// tempDir returns a temporary directory which is removed when the test finishes
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+// saveAll saves a snapshot of every given value in order, so the last one is the newest
+func saveAll(t *testing.T, files Files, values ...testData) {
+	for _, v := range values {
+		if err := files.Save(v); err != nil {
+			t.Fatalf("could not save %v: %v", v, err)
+		}
+	}
+}
+
+// corrupt flips a byte of the file at the given path, counting from its end if offset is negative
+func corrupt(t *testing.T, path string, offset int) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset < 0 {
+		offset += len(b)
+	}
+	b[offset] ^= 0xff
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	for _, codec := range []Codec{Gob, JSON, Binary} {
+		for _, compression := range []Compression{nil, Gzip} {
+			files := Files{Location: filepath.Join(tempDir(t), "data.gob"), Codec: codec, Compression: compression}
+			saveAll(t, files, testData{N: 1, Name: "one"})
+
+			var loaded testData
+			if err := files.Load(&loaded); err != nil {
+				t.Fatalf("could not load %s snapshot: %v", codec.Name(), err)
+			}
+			if loaded != (testData{N: 1, Name: "one"}) {
+				t.Errorf("loaded %v from %s snapshot", loaded, codec.Name())
+			}
+		}
+	}
+}
+
+func TestLoadNoSnapshot(t *testing.T) {
+	files := Files{Location: filepath.Join(tempDir(t), "data.gob")}
+
+	var loaded testData
+	if err := files.Load(&loaded); err != ErrNoSnapshot {
+		t.Errorf("got %v loading without snapshots, want ErrNoSnapshot", err)
+	}
+	if err := files.Check(&loaded); !os.IsNotExist(err) {
+		t.Errorf("got %v checking without snapshots, want a not exist error", err)
+	}
+}
+
+func TestLoadFallsBack(t *testing.T) {
+	dir := tempDir(t)
+	newest := filepath.Join(dir, "data.gob")
+	files := Files{Location: newest, Keep: 3}
+	saveAll(t, files, testData{N: 1}, testData{N: 2}, testData{N: 3})
+
+	tests := []struct {
+		name string
+		// damage damages the snapshots
+		damage func()
+		want   int
+	}{
+		{"newest", func() {}, 3},
+		{"corrupted newest", func() { corrupt(t, newest, 20) }, 2},
+		{"missing newest", func() { _ = os.Remove(newest) }, 2},
+		{"corrupted previous", func() { corrupt(t, newest+".1", -1) }, 1},
+	}
+	for _, test := range tests {
+		test.damage()
+
+		var loaded testData
+		if err := files.Load(&loaded); err != nil {
+			t.Fatalf("%s: could not load: %v", test.name, err)
+		}
+		if loaded.N != test.want {
+			t.Errorf("%s: loaded %d, want %d", test.name, loaded.N, test.want)
+		}
+	}
+
+	corrupt(t, newest+".2", len(magic))
+	var loaded testData
+	if err := files.Load(&loaded); err == nil || err == ErrNoSnapshot {
+		t.Errorf("got %v loading only corrupted snapshots, want an error", err)
+	}
+}
+
+func TestLoadFallsBackOnInvalidValue(t *testing.T) {
+	files := Files{Location: filepath.Join(tempDir(t), "data.gob")}
+	saveAll(t, files, testData{N: 1}, testData{N: -1})
+
+	var loaded testData
+	if err := files.Load(&loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.N != 1 {
+		t.Errorf("loaded %d, want the valid previous snapshot", loaded.N)
+	}
+}
+
+func TestCheckDoesNotFallBack(t *testing.T) {
+	newest := filepath.Join(tempDir(t), "data.gob")
+	files := Files{Location: newest}
+	saveAll(t, files, testData{N: 1}, testData{N: 2})
+	corrupt(t, newest, -1)
+
+	var loaded testData
+	if err := files.Check(&loaded); err == nil {
+		t.Error("checked a corrupted snapshot")
+	}
+}
+
+func TestLoadHeaderlessGob(t *testing.T) {
+	newest := filepath.Join(tempDir(t), "data.gob")
+	f, err := os.Create(newest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewEncoder(f).Encode(struct{ N int }{N: 42}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	schema := &Schema{Version: 2}
+	schema.Migrate(1, func() interface{} { return &struct{ N int }{} }, func(old interface{}) (interface{}, error) {
+		return testData{N: old.(*struct{ N int }).N, Name: "migrated"}, nil
+	})
+	files := Files{Location: newest, Schema: schema}
+
+	var loaded testData
+	if err := files.Load(&loaded); err != nil {
+		t.Fatalf("could not load headerless gob snapshot: %v", err)
+	}
+	if loaded != (testData{N: 42, Name: "migrated"}) {
+		t.Errorf("loaded %v from headerless gob snapshot", loaded)
+	}
+
+	infos, err := files.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Format != 0 || infos[0].Codec != "gob" || infos[0].SchemaVersion != 1 {
+		t.Errorf("got %+v inspecting headerless gob snapshot", infos)
+	}
+
+	// Saving keeps the headerless snapshot as the previous one
+	saveAll(t, files, testData{N: 43})
+	if err := files.Load(&loaded); err != nil || loaded.N != 43 {
+		t.Errorf("loaded %v, %v after saving over a headerless gob snapshot", loaded, err)
+	}
+	corrupt(t, newest, -1)
+	if err := files.Load(&loaded); err != nil || loaded.N != 42 {
+		t.Errorf("loaded %v, %v falling back to a headerless gob snapshot", loaded, err)
+	}
+}
+
+func TestLoadHeaderlessGobRejected(t *testing.T) {
+	// writeGob replaces the newest snapshot with a headerless gob one followed by the given data
+	writeGob := func(newest string, trailing []byte) {
+		f, err := os.Create(newest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := gob.NewEncoder(f).Encode(testData{N: 2}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(trailing); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		keys   *Keys
+		damage func(newest string)
+	}{
+		{"trailing data", nil, func(newest string) { writeGob(newest, []byte("trailing")) }},
+		{"keys configured", testKeys(t, "k1"), func(newest string) { writeGob(newest, nil) }},
+		{"corrupted magic", nil, func(newest string) { corrupt(t, newest, 0) }},
+	}
+	for _, test := range tests {
+		newest := filepath.Join(tempDir(t), "data.gob")
+		files := Files{Location: newest, Keys: test.keys}
+		saveAll(t, files, testData{N: 1}, testData{N: 2})
+		test.damage(newest)
+
+		var loaded testData
+		if err := files.Check(&loaded); err == nil {
+			t.Errorf("%s: checked %v as a headerless gob snapshot", test.name, loaded)
+		}
+		if err := files.Load(&loaded); err != nil || loaded.N != 1 {
+			t.Errorf("%s: loaded %v, %v, want the previous snapshot", test.name, loaded, err)
+		}
+	}
+}
+
+func TestLoadSchemaErrorDoesNotFallBack(t *testing.T) {
+	newest := filepath.Join(tempDir(t), "data.gob")
+	saveAll(t, Files{Location: newest}, testData{N: 1})
+	saveAll(t, Files{Location: newest, Schema: &Schema{Version: 3}}, testData{N: 2})
+
+	var loaded testData
+	err := Files{Location: newest, Schema: &Schema{Version: 2}}.Load(&loaded)
+	if _, ok := err.(*SchemaError); !ok {
+		t.Errorf("got %v loading a snapshot of a newer schema, want a *SchemaError", err)
+	}
+}
@@ -0,0 +1,213 @@
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Store stores snapshot files by name
+type Store interface {
+	// Open opens the snapshot file with the given name for reading. It returns an error satisfying os.IsNotExist if
+	// there is no such file.
+	Open(name string) (io.ReadCloser, error)
+	// Put stores the snapshot file with the given name read from r, atomically replacing the previous one if any, so
+	// it is never left incomplete
+	Put(name string, r io.Reader) error
+	// Remove removes the snapshot file with the given name, if it exists
+	Remove(name string) error
+	// Stat returns the size and modification time of the snapshot file with the given name. It returns an error
+	// satisfying os.IsNotExist if there is no such file.
+	Stat(name string) (size int64, modTime time.Time, err error)
+}
+
+// Renamer is implemented by stores which can rename and link snapshot files, so they are rotated without copying them
+type Renamer interface {
+	// Rename renames the snapshot file with the given name, atomically replacing the one with the new name if any
+	Rename(from, to string) error
+	// Link gives another name to the snapshot file with the given name, replacing the one with the new name if any,
+	// so the file has both names
+	Link(from, to string) error
+}
+
+// defaultKVName is the name of the snapshot file in a key-value file when the location has no fragment
+const defaultKVName = "snapshot"
+
+// ParseLocation returns the store and the name of the snapshot file in it at the given location, which is one of:
+//
+//	/path/to/data.gob                        a file in a directory
+//	kv:/path/to/snapshots.kv#data            a key in a key-value file, "snapshot" if there is no fragment
+//	s3://bucket/prefix/data?endpoint=<url>   an object in an S3 compatible service, see S3
+func ParseLocation(location string) (Store, string, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme == "" {
+		return Dir(filepath.Dir(location)), filepath.Base(location), nil
+	}
+
+	switch u.Scheme {
+	case "file":
+		return Dir(filepath.Dir(u.Path)), filepath.Base(u.Path), nil
+	case "kv":
+		p := u.Path
+		if u.Opaque != "" {
+			p = u.Opaque
+		}
+		if p == "" {
+			return nil, "", fmt.Errorf("missing key-value file path in snapshot location %s", location)
+		}
+		name := u.Fragment
+		if name == "" {
+			name = defaultKVName
+		}
+		return KVFile(p), name, nil
+	case "s3":
+		key := strings.TrimPrefix(u.Path, "/")
+		if u.Host == "" || key == "" {
+			return nil, "", fmt.Errorf("missing bucket or key in snapshot location %s", location)
+		}
+		prefix, name := path.Split(key)
+		q := u.Query()
+		return &S3{
+			Endpoint: q.Get("endpoint"),
+			Region:   q.Get("region"),
+			Bucket:   u.Host,
+			Prefix:   prefix,
+		}, name, nil
+	}
+	return nil, "", fmt.Errorf("unknown scheme %q in snapshot location %s", u.Scheme, location)
+}
+
+// SuffixLocation returns the location of the snapshot file in the same store as the one at the given location, with
+// its name followed by the given suffix
+func SuffixLocation(location, suffix string) string {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme == "" {
+		return location + suffix
+	}
+	if u.Scheme == "kv" {
+		if u.Fragment == "" {
+			return strings.TrimSuffix(location, "#") + "#" + defaultKVName + suffix
+		}
+		return location + suffix
+	}
+	u.Path += suffix
+	u.RawPath = ""
+	return u.String()
+}
+
+// AbsLocation returns the given location with its local path made absolute, so it does not depend on the working
+// directory
+func AbsLocation(location string) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme == "" {
+		return filepath.Abs(location)
+	}
+	if u.Scheme != "kv" || u.Opaque == "" {
+		return location, nil
+	}
+	p, err := filepath.Abs(u.Opaque)
+	if err != nil {
+		return "", err
+	}
+	if u.Fragment != "" {
+		p += "#" + u.Fragment
+	}
+	return "kv:" + p, nil
+}
+
+// Dir stores snapshot files in a directory. They are written to a temporary file, synced to disk and renamed, and
+// rotated with renames and hard links.
+type Dir string
+
+// Open opens the snapshot file with the given name
+func (d Dir) Open(name string) (io.ReadCloser, error) {
+	return os.Open(d.path(name))
+}
+
+// Put atomically writes the snapshot file with the given name
+func (d Dir) Put(name string, r io.Reader) error {
+	tmp, err := ioutil.TempFile(string(d), "."+name+".")
+	if err != nil {
+		return fmt.Errorf("could not create snapshot file: %v", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), d.path(name)); err != nil {
+		return fmt.Errorf("could not write snapshot: %v", err)
+	}
+	return syncDir(string(d))
+}
+
+// Remove removes the snapshot file with the given name
+func (d Dir) Remove(name string) error {
+	if err := os.Remove(d.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Rename renames the snapshot file with the given name
+func (d Dir) Rename(from, to string) error {
+	if err := os.Rename(d.path(from), d.path(to)); err != nil {
+		return err
+	}
+	return syncDir(string(d))
+}
+
+// Link hard links the snapshot file with the given name to another name
+func (d Dir) Link(from, to string) error {
+	if err := d.Remove(to); err != nil {
+		return err
+	}
+	if err := os.Link(d.path(from), d.path(to)); err != nil {
+		return err
+	}
+	return syncDir(string(d))
+}
+
+// Stat returns the size and modification time of the snapshot file with the given name
+func (d Dir) Stat(name string) (int64, time.Time, error) {
+	fi, err := os.Stat(d.path(name))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return fi.Size(), fi.ModTime(), nil
+}
+
+func (d Dir) path(name string) string {
+	return filepath.Join(string(d), name)
+}
+
+// syncDir syncs a directory to disk, so a file renamed into it is not lost on a crash
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not sync snapshot directory: %v", err)
+	}
+	defer dir.Close()
+
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("could not sync snapshot directory: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package snapshot
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseLocation(t *testing.T) {
+	tests := []struct {
+		location string
+		store    Store
+		name     string
+	}{
+		{"/var/lib/app/data.gob", Dir("/var/lib/app"), "data.gob"},
+		{"file:///var/lib/app/data.gob", Dir("/var/lib/app"), "data.gob"},
+		{"kv:/var/lib/app/snapshots.kv#data", KVFile("/var/lib/app/snapshots.kv"), "data"},
+		{"kv:/var/lib/app/snapshots.kv", KVFile("/var/lib/app/snapshots.kv"), "snapshot"},
+		{"s3://bucket/app/data?endpoint=http://127.0.0.1:9000&region=eu-west-1", &S3{
+			Endpoint: "http://127.0.0.1:9000",
+			Region:   "eu-west-1",
+			Bucket:   "bucket",
+			Prefix:   "app/",
+		}, "data"},
+	}
+	for _, test := range tests {
+		store, name, err := ParseLocation(test.location)
+		if err != nil {
+			t.Errorf("could not parse %s: %v", test.location, err)
+			continue
+		}
+		if name != test.name {
+			t.Errorf("got name %q from %s, want %q", name, test.location, test.name)
+		}
+		if s3, ok := store.(*S3); ok {
+			if *s3 != *test.store.(*S3) {
+				t.Errorf("got %+v from %s, want %+v", s3, test.location, test.store)
+			}
+		} else if store != test.store {
+			t.Errorf("got %#v from %s, want %#v", store, test.location, test.store)
+		}
+	}
+
+	for _, location := range []string{"kv:", "s3://bucket", "s3:///data", "ftp://host/data"} {
+		if _, _, err := ParseLocation(location); err == nil {
+			t.Errorf("parsed invalid location %s", location)
+		}
+	}
+}
+
+func TestSuffixLocation(t *testing.T) {
+	tests := []struct {
+		location string
+		want     string
+	}{
+		{"/var/lib/app/data.gob", "/var/lib/app/data.gob.refresh"},
+		{"file:///var/lib/app/data.gob", "file:///var/lib/app/data.gob.refresh"},
+		{"kv:/var/lib/app/snapshots.kv#data", "kv:/var/lib/app/snapshots.kv#data.refresh"},
+		{"kv:/var/lib/app/snapshots.kv", "kv:/var/lib/app/snapshots.kv#snapshot.refresh"},
+		{"s3://bucket/app/data?endpoint=http://127.0.0.1:9000&region=eu-west-1",
+			"s3://bucket/app/data.refresh?endpoint=http://127.0.0.1:9000&region=eu-west-1"},
+	}
+	for _, test := range tests {
+		got := SuffixLocation(test.location, ".refresh")
+		if got != test.want {
+			t.Errorf("got %s from %s, want %s", got, test.location, test.want)
+			continue
+		}
+
+		store, name, err := ParseLocation(test.location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		suffixedStore, suffixedName, err := ParseLocation(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if suffixedName != name+".refresh" {
+			t.Errorf("got name %q from %s, want %q", suffixedName, got, name+".refresh")
+		}
+		if s3, ok := store.(*S3); ok {
+			if *s3 != *suffixedStore.(*S3) {
+				t.Errorf("got %+v from %s, want %+v", suffixedStore, got, s3)
+			}
+		} else if suffixedStore != store {
+			t.Errorf("got %#v from %s, want %#v", suffixedStore, got, store)
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir := Dir(tempDir(t))
+
+	putString(t, dir, "a", "value")
+	if got := readStored(t, dir, "a"); got != "value" {
+		t.Errorf("read %q", got)
+	}
+	if err := dir.Link("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Rename("a", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.Open("a"); !os.IsNotExist(err) {
+		t.Errorf("got %v opening a renamed file, want a not exist error", err)
+	}
+	for _, name := range []string{"b", "c"} {
+		if got := readStored(t, dir, name); got != "value" {
+			t.Errorf("read %q from %s", got, name)
+		}
+	}
+
+	if err := dir.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Remove("b"); err != nil {
+		t.Errorf("got %v removing a missing file", err)
+	}
+	if _, _, err := dir.Stat("b"); !os.IsNotExist(err) {
+		t.Errorf("got %v getting the size of a removed file, want a not exist error", err)
+	}
+}
+
+func TestRotateRenamesInDir(t *testing.T) {
+	newest := filepath.Join(tempDir(t), "data.gob")
+	files := Files{Location: newest, Keep: 3}
+	saveAll(t, files, testData{N: 1}, testData{N: 2})
+	before, err := os.Stat(newest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saveAll(t, files, testData{N: 3})
+	after, err := os.Stat(newest + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) || !before.ModTime().Equal(after.ModTime()) {
+		t.Error("the previous snapshot was copied instead of linked")
+	}
+	if _, err := os.Stat(newest + stagedSuffix); !os.IsNotExist(err) {
+		t.Errorf("got %v for the staged snapshot, want it renamed", err)
+	}
+}
+
+// failingCodec is a codec which fails to encode after writing part of the snapshot
+type failingCodec struct{}
+
+func (failingCodec) Name() string {
+	return "gob"
+}
+
+func (failingCodec) Encode(w io.Writer, v interface{}) error {
+	_, _ = w.Write([]byte("partial"))
+	return errors.New("encoding failed")
+}
+
+func (failingCodec) Decode(r io.Reader, v interface{}) error {
+	return Gob.Decode(r, v)
+}
+
+func TestFailedSaveKeepsSnapshots(t *testing.T) {
+	dir := tempDir(t)
+	for _, location := range []string{filepath.Join(dir, "data.gob"), "kv:" + filepath.Join(dir, "snapshots.kv")} {
+		files := Files{Location: location, Keep: 3}
+		saveAll(t, files, testData{N: 1}, testData{N: 2}, testData{N: 3})
+
+		failing := files
+		failing.Codec = failingCodec{}
+		if err := failing.Save(testData{N: 4}); err == nil {
+			t.Fatalf("saved to %s with a failing codec", location)
+		}
+
+		store, newest, err := files.store()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for age, want := range []int{3, 2, 1} {
+			var loaded testData
+			if err := files.read(store, agedName(newest, age), &loaded); err != nil || loaded.N != want {
+				t.Errorf("%s: loaded %v, %v from age %d after a failed save, want %d", location, loaded, err, age, want)
+			}
+		}
+		if _, err := store.Open(newest + stagedSuffix); !os.IsNotExist(err) {
+			t.Errorf("%s: got %v opening the staged snapshot of a failed save, want it removed", location, err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/rogerclotet/graceful-restart/snapshot"
+)
+
+const snapshotUsage = `usage: %s [flags] snapshot <command> [arguments]
+
+Inspect and edit snapshots offline. Snapshots are read with any codec and migrated to the current schema version,
+and written with the configured codec, schema version, encryption key and compression.
+
+commands:
+  info [-format text|json] [location]   describe the snapshot and the previous ones kept, or the ones at a location
+  dump [-format json|text] [location]   print the data in the snapshot, or in the one at the given location
+  diff <a> <b>                          print the differences between the data in the snapshots at two locations
+  load [-to location] <data.json>       save the data in a JSON file, as printed by dump, as the newest snapshot
+
+Locations are file paths, kv:<path>#<name> or s3://<bucket>/<key>?endpoint=<url>&region=<region>, as in -snapshot.
+`
+
+// runSnapshotCommand runs a snapshot subcommand with the given arguments, where location is the configured snapshot
+// location and files returns the snapshot files at a location
+func runSnapshotCommand(args []string, location string, files func(location string) snapshot.Files) error {
+	if len(args) == 0 {
+		return snapshotUsageError()
+	}
+
+	switch args[0] {
+	case "info":
+		return snapshotInfo(args[1:], location, files)
+	case "dump":
+		return snapshotDump(args[1:], location, files)
+	case "diff":
+		return snapshotDiff(args[1:], files)
+	case "load":
+		return snapshotLoad(args[1:], location, files)
+	}
+	return snapshotUsageError()
+}
+
+func snapshotUsageError() error {
+	fmt.Fprintf(os.Stderr, snapshotUsage, os.Args[0])
+	return fmt.Errorf("invalid snapshot command")
+}
+
+func snapshotInfo(args []string, location string, files func(location string) snapshot.Files) error {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	format := fs.String("format", "text", "output format, text or json")
+	_ = fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		location = fs.Arg(0)
+	}
+	infos, err := files(location).Inspect()
+	if err != nil {
+		return err
+	}
+	if len(infos) == 0 {
+		return fmt.Errorf("no snapshot in %s", location)
+	}
+
+	switch *format {
+	case "json":
+		return printJSON(os.Stdout, infos)
+	case "text":
+		for _, info := range infos {
+			fmt.Printf("%s\n  size:     %d bytes\n  modified: %s\n", info.Name, info.Size, info.ModTime)
+			if info.Error != "" {
+				fmt.Printf("  error:    %s\n", info.Error)
+				continue
+			}
+			fmt.Printf("  format:   %d\n  codec:    %s\n  schema:   version %d\n",
+				info.Format, info.Codec, info.SchemaVersion)
+			if info.Checksum != "" {
+				fmt.Printf("  sha256:   %s\n", info.Checksum)
+			}
+			if info.Compression != "" {
+				fmt.Printf("  compress: %s\n", info.Compression)
+			}
+			if info.KeyID != "" {
+				fmt.Printf("  key:      %s\n", info.KeyID)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown format %q", *format)
+}
+
+func snapshotDump(args []string, location string, files func(location string) snapshot.Files) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	format := fs.String("format", "json", "output format, json or text")
+	_ = fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		location = fs.Arg(0)
+	}
+	var d Data
+	if err := files(location).Check(&d); err != nil {
+		return fmt.Errorf("could not read snapshot %s: %v", location, err)
+	}
+
+	switch *format {
+	case "json":
+		return printJSON(os.Stdout, d)
+	case "text":
+		fields, err := dataFields(d)
+		if err != nil {
+			return err
+		}
+		for _, name := range sortedNames(fields) {
+			value, _ := json.Marshal(fields[name])
+			fmt.Printf("%s: %s\n", name, value)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown format %q", *format)
+}
+
+func snapshotDiff(args []string, files func(location string) snapshot.Files) error {
+	if len(args) != 2 {
+		return snapshotUsageError()
+	}
+
+	var fields [2]map[string]interface{}
+	for i, location := range args {
+		var d Data
+		if err := files(location).Check(&d); err != nil {
+			return fmt.Errorf("could not read snapshot %s: %v", location, err)
+		}
+		var err error
+		if fields[i], err = dataFields(d); err != nil {
+			return err
+		}
+	}
+
+	all := make(map[string]interface{})
+	for _, f := range fields {
+		for name, value := range f {
+			all[name] = value
+		}
+	}
+
+	differences := 0
+	for _, name := range sortedNames(all) {
+		a, b := fields[0][name], fields[1][name]
+		if reflect.DeepEqual(a, b) {
+			continue
+		}
+		differences++
+		ja, _ := json.Marshal(a)
+		jb, _ := json.Marshal(b)
+		fmt.Printf("%s: %s -> %s\n", name, ja, jb)
+	}
+	if differences == 0 {
+		fmt.Println("no differences")
+	}
+	return nil
+}
+
+func snapshotLoad(args []string, location string, files func(location string) snapshot.Files) error {
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	to := fs.String("to", location, "snapshot location to write to, rotating the existing snapshots")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return snapshotUsageError()
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	var d Data
+	if err := decoder.Decode(&d); err != nil {
+		return fmt.Errorf("could not decode %s: %v", fs.Arg(0), err)
+	}
+	if err := d.Validate(); err != nil {
+		return err
+	}
+
+	if err := files(*to).Save(d); err != nil {
+		return err
+	}
+	fmt.Printf("saved %s, keeping the previous snapshots\n", *to)
+	return nil
+}
+
+// dataFields returns the fields of the data as encoded in JSON
+func dataFields(d Data) (map[string]interface{}, error) {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	err = json.Unmarshal(b, &fields)
+	return fields, err
+}
+
+func sortedNames(fields map[string]interface{}) []string {
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}